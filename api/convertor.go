@@ -2,6 +2,14 @@ package handler
 
 import (
 	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	cryptorand "crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -10,12 +18,13 @@ import (
 	"log"
 	"math"
 	"math/rand"
-	"mime/multipart"
+	"mime"
 	"net/http"
 	"os"
 	"os/signal"
 	"path"
-	"reflect"
+	"sort"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
@@ -23,14 +32,12 @@ import (
 	"github.com/go-audio/aiff"
 	"github.com/go-audio/audio"
 	"github.com/go-audio/generator"
-	"github.com/go-audio/midi"
 	"github.com/go-audio/wav"
 )
 
 const protocol string = "http"
 const domain string = "localhost"
 const port string = "8080"
-const inputFileDir string = "/tmp/input/"
 const outputFileDir string = "/tmp/output/"
 const maxUploadSizeMb int64 = 10
 
@@ -38,33 +45,249 @@ const maxUploadSizeMb int64 = 10
 const maxUploadSizeBytes int64 = maxUploadSizeMb << 20
 const maxRequestBodySizeBytes int64 = maxUploadSizeBytes + 512
 
+// JSON request bodies are limited to 1MB
+const maxJSONBodySizeBytes int64 = 1048576
+
 const downloadTTLMins int64 = 1
 
-// Setting global audio config for 16/44/mono
-const audioBitDepth int = 16
-const audioSampleRate int = 44100
+// mixdown limits, levels in dB relative to full scale
+const maxMixLayers int = 16
+const defaultMixHeadroomDB float64 = 1
+const maxMixHeadroomDB float64 = 24
+const minLayerGainDB float64 = -60
+const maxLayerGainDB float64 = 12
+
+// conversions that run longer than this are cancelled, MOTIVIC_MAX_RENDER_SECONDS overrides it
+const defaultMaxRenderSecs int64 = 25
+const maxRenderTimeEnv string = "MOTIVIC_MAX_RENDER_SECONDS"
+const renderCancelGracePeriod time.Duration = 100 * time.Millisecond
+
+// artifact storage is configured with environment variables, local disk is the default
+const artifactStoreEnv string = "MOTIVIC_ARTIFACT_STORE"
+const localArtifactStore string = "local"
+const s3ArtifactStore string = "s3"
+const s3EndpointEnv string = "MOTIVIC_S3_ENDPOINT"
+const s3RegionEnv string = "MOTIVIC_S3_REGION"
+const s3BucketEnv string = "MOTIVIC_S3_BUCKET"
+const s3AccessKeyIDEnv string = "MOTIVIC_S3_ACCESS_KEY_ID"
+const s3SecretAccessKeyEnv string = "MOTIVIC_S3_SECRET_ACCESS_KEY"
+const s3ExpiresHeader string = "X-Amz-Meta-Motivic-Expires"
+
+// Default audio config for 16/44/mono, overridden per request by RenderOptions
+const defaultAudioBitDepth int = 16
+const defaultAudioSampleRate int = 44100
+const defaultAudioChannels int = 1
+const intSampleFormat string = "int"
+const floatSampleFormat string = "float"
+const wavFormatIEEEFloat int = 3
+
+// FLAC frames hold a fixed number of samples per channel, the last frame may be shorter
+const flacBlockSize int = 4096
+const flacMaxRiceParameter uint = 14
+const flacMaxPartitionOrder uint = 8
+const flacMaxFixedOrder int = 4
 const midiNoteValueOffset int = -11
-const midiDurationValueDivisor int = 8
-const defaultWaveForm generator.WaveType = generator.WaveSine
+const defaultVoice string = "sine"
+const restValue int = -1
+const restName string = "rest"
 const wavFile string = "wav"
+const aiffFile string = "aiff"
+const flacFile string = "flac"
+const midiFile string = "midi"
+const midiFileExtension string = "mid"
+const jsonFile string = "json"
+const zipFile string = "zip"
+
+// Standard MIDI File export settings (mirrors Config.midiTicksPerQuarterNote in the web app)
+const midiTicksPerQuarterNote int = 128
+const midiDefaultVelocity int = 100
+const midiMaxVelocity int = 127
+const midiMaxMicrosecondsPerQuarterNote int = 0xFFFFFF
+const midiDefaultChannel int = 0
+const midiPercussionChannel int = 9
+
+// hairpins ramp from the dynamic in effect where they start to their target
+const crescendoMarking string = "crescendo"
+const decrescendoMarking string = "decrescendo"
+
+// MIDI velocity of each dynamic marking, from softest to loudest
+var dynamicMarkings = []string{"ppp", "pp", "p", "mp", "mf", "f", "ff", "fff"}
+var dynamicVelocities = map[string]int{
+	"ppp": 16,
+	"pp":  33,
+	"p":   49,
+	"mp":  64,
+	"mf":  80,
+	"f":   96,
+	"ff":  112,
+	"fff": 127,
+}
+
+// FM voices are stacks of 2 to 4 sine operators
+const minFMOperators int = 2
+const maxFMOperators int = 4
+const maxFMIndex float64 = 32
+
+// sampler loop modes (the loop_mode values of SFZ) and the defaults of sample map regions
+const noLoopMode string = "no_loop"
+const oneShotLoopMode string = "one_shot"
+const loopContinuousMode string = "loop_continuous"
+const loopSustainMode string = "loop_sustain"
+const defaultSamplerReleaseSecs float64 = 0.05
+const minSamplerReleaseSecs float64 = 0.005
+const defaultLoopCrossfadeSecs float64 = 0.01
+const maxSampleFiles int = 32
+const midiMaxKey int = 127
+
+// decay times of plucked strings, from fully damped to undamped
+const pluckMinDecaySecs float64 = 0.05
+const pluckMaxDecaySecs float64 = 10
+
+// Motivic durations are expressed in 64th notes, so a quarter note is 16 units
+const motivicUnitsPerQuarterNote int = 16
+const microsecondsPerMinute int = 60000000
+
+// extension and MIME type of every downloadable output format
+var fileFormats = map[string]fileFormat{
+	wavFile:  {Extension: "wav", MIMEType: "audio/wav"},
+	aiffFile: {Extension: "aiff", MIMEType: "audio/aiff"},
+	flacFile: {Extension: "flac", MIMEType: "audio/flac"},
+	midiFile: {Extension: midiFileExtension, MIMEType: "audio/midi"},
+	jsonFile: {Extension: "json", MIMEType: "application/json"},
+	zipFile:  {Extension: "zip", MIMEType: "application/zip"},
+}
+
+// Accept header media types of the audio output formats, including legacy aliases
+var audioMediaTypes = map[string]string{
+	"audio/wav":      wavFile,
+	"audio/wave":     wavFile,
+	"audio/x-wav":    wavFile,
+	"audio/vnd.wave": wavFile,
+	"audio/aiff":     aiffFile,
+	"audio/x-aiff":   aiffFile,
+	"audio/flac":     flacFile,
+	"audio/x-flac":   flacFile,
+	"audio/midi":     midiFile,
+	"audio/x-midi":   midiFile,
+}
+
+var supportedSampleRates = []int{22050, 32000, 44100, 48000, 88200, 96000}
+
+// bit depths available for each sample format
+var supportedBitDepths = map[string][]int{
+	intSampleFormat:   {16, 24, 32},
+	floatSampleFormat: {32},
+}
 
-var audioFormat = audio.FormatMono44100
-var waveForm = map[string]generator.WaveType{
-	"sine":     generator.WaveSine,
-	"triangle": generator.WaveTriangle,
-	"square":   generator.WaveSqr,
-	"sawtooth": generator.WaveSaw,
+// every voice fades in and out of each note to avoid clicks at note boundaries,
+// brighter waveforms get shorter attacks and lower sustain levels.
+// Plucked strings and FM voices shape their notes themselves, so their envelopes only soften the start and the release.
+var waveForm = map[string]oscillatorVoice{
+	"sine":        {WaveType: generator.WaveSine, Envelope: Envelope{Attack: 10, Decay: 50, Sustain: 0.9, Release: 30}},
+	"triangle":    {WaveType: generator.WaveTriangle, Envelope: Envelope{Attack: 8, Decay: 60, Sustain: 0.85, Release: 30}},
+	"square":      {WaveType: generator.WaveSqr, Envelope: Envelope{Attack: 5, Decay: 80, Sustain: 0.6, Release: 25}},
+	"sawtooth":    {WaveType: generator.WaveSaw, Envelope: Envelope{Attack: 5, Decay: 80, Sustain: 0.65, Release: 25}},
+	"lute":        {Envelope: Envelope{Attack: 2, Sustain: 1, Release: 40}, Pluck: &PluckedString{Damping: 0.55, Brightness: 0.4}},
+	"harpsichord": {Envelope: Envelope{Attack: 1, Sustain: 1, Release: 20}, Pluck: &PluckedString{Damping: 0.3, Brightness: 0.9}},
+	"bell":        {Envelope: Envelope{Attack: 1, Sustain: 1, Release: 20}, FM: fmPresets["bell"]},
+	"epiano":      {Envelope: Envelope{Attack: 1, Sustain: 1, Release: 20}, FM: fmPresets["epiano"]},
+	"brass":       {Envelope: Envelope{Attack: 1, Sustain: 1, Release: 20}, FM: fmPresets["brass"]},
+}
+
+// operator setups of the FM voices, carriers are listed before the operators modulating them
+var fmPresets = map[string]*FMVoice{
+	// inharmonic modulator with a long decay
+	"bell": {Operators: []FMOperator{
+		{Ratio: 1, Index: 1, Envelope: Envelope{Attack: 1, Decay: 2500, Sustain: 0, Release: 300}},
+		{Ratio: 3.5, Index: 4, Envelope: Envelope{Attack: 1, Decay: 1500, Sustain: 0, Release: 300}, Modulates: fmOperator(0)},
+	}},
+	// a warm body and a short metallic tine, each a carrier with its own modulator
+	"epiano": {Operators: []FMOperator{
+		{Ratio: 1, Index: 0.7, Envelope: Envelope{Attack: 2, Decay: 1500, Sustain: 0.3, Release: 150}},
+		{Ratio: 1, Index: 1.8, Envelope: Envelope{Attack: 1, Decay: 400, Sustain: 0.2, Release: 100}, Modulates: fmOperator(0)},
+		{Ratio: 1, Index: 0.3, Envelope: Envelope{Attack: 1, Decay: 300, Sustain: 0, Release: 100}},
+		{Ratio: 14, Index: 1.5, Envelope: Envelope{Attack: 1, Decay: 80, Sustain: 0, Release: 50}, Modulates: fmOperator(2)},
+	}},
+	// the modulator opens up slower than the carrier, with feedback for a buzzier tone
+	"brass": {Operators: []FMOperator{
+		{Ratio: 1, Index: 1, Envelope: Envelope{Attack: 60, Decay: 200, Sustain: 0.8, Release: 80}},
+		{Ratio: 1, Index: 3.5, Envelope: Envelope{Attack: 80, Decay: 250, Sustain: 0.6, Release: 80}, Modulates: fmOperator(0), Feedback: 0.3},
+	}},
 }
 var outputDirs = []string{"input", "output"}
 
+// scale degrees of each mode in semitones above the key (mirrors Config.modes in the web app)
+var modes = map[string][]int{
+	"chromatic":  {0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11},
+	"whole":      {0, 2, 4, 6, 8, 10},
+	"ionian":     {0, 2, 4, 5, 7, 9, 11},
+	"dorian":     {0, 2, 3, 5, 7, 9, 10},
+	"phrygian":   {0, 1, 3, 5, 7, 8, 10},
+	"lydian":     {0, 2, 4, 6, 7, 9, 11},
+	"mixolydian": {0, 2, 4, 5, 7, 9, 10},
+	"aeolian":    {0, 2, 3, 5, 7, 8, 10},
+	"locrian":    {0, 1, 3, 5, 6, 8, 10},
+}
+
+// semitones from the mode's tonic down to the tonic of its relative major scale
+var modeTonicOffsets = map[string]int{
+	"ionian":     0,
+	"dorian":     2,
+	"phrygian":   4,
+	"lydian":     5,
+	"mixolydian": 7,
+	"aeolian":    9,
+	"locrian":    11,
+}
+
+// number of sharps (positive) or flats (negative) of each major key, indexed by pitch class
+var majorKeySignatures = []int{0, -5, 2, -3, 4, -1, 6, 1, -4, 3, -2, 5}
+
 // APIResponse : response for /download/<filename>
 type APIResponse struct {
 	URL              string    `json:"url"`
 	CreatedTimeStamp time.Time `json:"created"`
 	Message          string    `json:"message"`
 	Success          bool      `json:"success"`
+	Error            *APIError `json:"error,omitempty"`
+}
+
+// APIError : typed error returned as JSON by every handler, pointing at the offending field and note when there is one
+type APIError struct {
+	Status    int    `json:"-"`
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	Field     string `json:"field,omitempty"`     // path of the offending request field, e.g. motif.notes[3].duration
+	NoteIndex *int   `json:"noteIndex,omitempty"` // index of the offending note within its motif
+	// every problem found when a request fails validation
+	Details []*APIError `json:"details,omitempty"`
+	err     error       // underlying error, if any
 }
 
+// API error codes
+const errCodeInvalidJSON string = "invalid_json"
+const errCodeInvalidValue string = "invalid_value"
+const errCodeEmptyBody string = "empty_body"
+const errCodeBodyTooLarge string = "body_too_large"
+const errCodeInvalidUpload string = "invalid_upload"
+const errCodeUnsupportedFormat string = "unsupported_format"
+const errCodeInvalidRenderOptions string = "invalid_render_options"
+const errCodeInvalidEnvelope string = "invalid_envelope"
+const errCodeInvalidVoice string = "invalid_voice"
+const errCodeInvalidMotif string = "invalid_motif"
+const errCodeInvalidMixdown string = "invalid_mixdown"
+const errCodeParseFailed string = "parse_failed"
+const errCodeSynthesisFailed string = "synthesis_failed"
+const errCodeEncodingFailed string = "encoding_failed"
+const errCodeRenderTimeout string = "render_timeout"
+const errCodeStorageFailed string = "storage_failed"
+const errCodeNotFound string = "not_found"
+const errCodeMethodNotAllowed string = "method_not_allowed"
+const errCodeUnsupportedMediaType string = "unsupported_media_type"
+const errCodeNotAcceptable string = "not_acceptable"
+const errCodeTooManyJobs string = "too_many_jobs"
+const errCodeInternal string = "internal_error"
+
 // FileSystem custom file system handler
 type FileSystem struct {
 	fs http.FileSystem
@@ -81,9 +304,10 @@ type Pitch struct {
 type Note struct {
 	Value    int `json:"value"` // scientific notation
 	Duration int `json:"duration"`
+	Velocity int `json:"velocity,omitempty"` // MIDI velocity (1-127), 0 plays the note at the motif's dynamics
 
-	// TODO: migrate to computed property methods
-	// computed
+	// computed from Value by PitchName, PitchOctave and ScientificPitch,
+	// kept for Motivic JSON and refreshed by Motif.Normalized
 	Name   string `json:"name"`   // Scientific pitch notation note https://en.wikipedia.org/wiki/Scientific_pitch_notation
 	Octave int    `json:"octave"` // Scientific pitch notation octave https://en.wikipedia.org/wiki/Scientific_pitch_notation
 	Pitch  string `json:"pitch"`  // Scientific pitch notation (note + octave) https://en.wikipedia.org/wiki/Scientific_pitch_notation
@@ -91,22 +315,113 @@ type Note struct {
 
 // Note factory function
 func newNote(v int, d int) Note {
-	name, octave := getNoteNameAndOctave(v)
-	pitchStr := fmt.Sprintf("%v%d", name, octave)
-	n := Note{Value: v, Duration: d, Name: name, Octave: octave, Pitch: pitchStr}
+	if v < 1 {
+		v = restValue
+	}
+	n := Note{Value: v, Duration: d}
+	n.Name, n.Octave, n.Pitch = n.PitchName(), n.PitchOctave(), n.ScientificPitch()
 	return n
 }
 
+// rests have a null value in Motivic JSON and a negative value in Go
+func (n Note) isRest() bool {
+	return n.Value < 1
+}
+
+// PitchName : note name of the value, e.g. "c#", or "rest"
+func (n Note) PitchName() string {
+	name, _ := getNoteNameAndOctave(n.Value)
+	return name
+}
+
+// PitchOctave : scientific pitch notation octave of the value, -1 for rests
+func (n Note) PitchOctave() int {
+	_, octave := getNoteNameAndOctave(n.Value)
+	return octave
+}
+
+// ScientificPitch : note name and octave of the value, e.g. "c#4", or "rest"
+func (n Note) ScientificPitch() string {
+	if n.isRest() {
+		return restName
+	}
+	name, octave := getNoteNameAndOctave(n.Value)
+	return fmt.Sprintf("%v%d", name, octave)
+}
+
 // MotifNote : Motivic.Note decorated with motif-relative computed fields
 type MotifNote struct {
 	Note
-	// relative (to Motif)
-	// TODO: migrate to computed property methods
+	// relative (to Motif), computed by Motif.NoteSteps, Motif.NoteStartingBeats and Motif.NoteInterval,
+	// kept for Motivic JSON and refreshed by Motif.Normalized
 	Steps        int `json:"steps"`        // relative to Motif.Notes[0].Value
 	StartingBeat int `json:"startingBeat"` // relative to Motif.Notes[0].StartingBeat
 	Interval     int `json:"interval"`     // relative to Motif.Key
 }
 
+// motifNoteJSON : Motivic JSON representation of a MotifNote, where the pitch fields of rests are null
+type motifNoteJSON struct {
+	Value        *int   `json:"value"`
+	Duration     int    `json:"duration"`
+	Velocity     int    `json:"velocity,omitempty"`
+	Name         string `json:"name"`
+	Octave       *int   `json:"octave"`
+	Pitch        string `json:"pitch"`
+	Steps        *int   `json:"steps"`
+	StartingBeat int    `json:"startingBeat"`
+	Interval     *int   `json:"interval"`
+}
+
+// MarshalJSON : write rests the way the web app does
+func (n MotifNote) MarshalJSON() ([]byte, error) {
+	j := motifNoteJSON{
+		Duration:     n.Duration,
+		Name:         n.Name,
+		Pitch:        n.Pitch,
+		StartingBeat: n.StartingBeat,
+	}
+	if n.isRest() {
+		j.Name = restName
+		j.Pitch = restName
+	} else {
+		j.Value = &n.Value
+		j.Velocity = n.Velocity
+		j.Octave = &n.Octave
+		j.Steps = &n.Steps
+		j.Interval = &n.Interval
+	}
+	return json.Marshal(j)
+}
+
+// UnmarshalJSON : read null note values as rests
+func (n *MotifNote) UnmarshalJSON(data []byte) error {
+	var j motifNoteJSON
+	if err := json.Unmarshal(data, &j); err != nil {
+		return err
+	}
+	*n = MotifNote{StartingBeat: j.StartingBeat}
+	n.Duration = j.Duration
+	n.Name = j.Name
+	n.Pitch = j.Pitch
+	if j.Value == nil {
+		n.Value = restValue
+		n.Octave = -1
+		return nil
+	}
+	n.Value = *j.Value
+	n.Velocity = j.Velocity
+	if j.Octave != nil {
+		n.Octave = *j.Octave
+	}
+	if j.Steps != nil {
+		n.Steps = *j.Steps
+	}
+	if j.Interval != nil {
+		n.Interval = *j.Interval
+	}
+	return nil
+}
+
 // Tempo : Motivic.Tempo class
 type Tempo struct {
 	Type  string `json:"type"`
@@ -116,12 +431,40 @@ type Tempo struct {
 // TimeSignature : Motivic.TimeSignature class
 type TimeSignature []int
 
+// TempoChange : tempo in effect from a position of the motif onwards
+type TempoChange struct {
+	StartingBeat int   `json:"startingBeat"` // relative to Motif.Notes[0].StartingBeat
+	Tempo        Tempo `json:"tempo"`
+}
+
+// TimeSignatureChange : time signature in effect from a position of the motif onwards
+type TimeSignatureChange struct {
+	StartingBeat  int           `json:"startingBeat"` // relative to Motif.Notes[0].StartingBeat
+	TimeSignature TimeSignature `json:"timeSignature"`
+}
+
+// DynamicChange : dynamic marking in effect from a position of the motif onwards,
+// or a hairpin gradually changing the dynamics up to its ending beat
+type DynamicChange struct {
+	StartingBeat int    `json:"startingBeat"`         // relative to Motif.Notes[0].StartingBeat
+	Marking      string `json:"marking"`              // "ppp" to "fff", "crescendo" or "decrescendo"
+	EndingBeat   int    `json:"endingBeat,omitempty"` // where a hairpin reaches its target
+	Target       string `json:"target,omitempty"`     // marking a hairpin ends at, defaults to the next marking louder or softer
+}
+
 // Meta : Motivic.Meta class
 type Meta struct {
 	Key           string        `json:"key"`
 	Mode          string        `json:"mode"`
 	Tempo         Tempo         `json:"tempo"`
 	TimeSignature TimeSignature `json:"timeSignature"`
+
+	// optional tempo map and meter changes, e.g. from imported MIDI files
+	TempoChanges         []TempoChange         `json:"tempoChanges,omitempty"`
+	TimeSignatureChanges []TimeSignatureChange `json:"timeSignatureChanges,omitempty"`
+
+	// optional dynamics in order of position, notes without a velocity are played at the level in effect
+	Dynamics []DynamicChange `json:"dynamics,omitempty"`
 }
 
 // Motif : Motivic.Motif melody class
@@ -130,6 +473,31 @@ type Motif struct {
 	Name  string      `json:"name"`
 	Meta  Meta        `json:"meta"`
 	Notes []MotifNote `json:"notes"`
+
+	// only set on motifs imported from MIDI files
+	Quantization *QuantizationReport `json:"quantization,omitempty"`
+}
+
+// QuantizationReport : timing error introduced by snapping MIDI ticks to Motivic duration units
+type QuantizationReport struct {
+	TicksPerQuarterNote int     `json:"ticksPerQuarterNote"`
+	Events              int     `json:"events"`          // note on and note off positions
+	QuantizedEvents     int     `json:"quantizedEvents"` // positions that had to move
+	MaxErrorTicks       float64 `json:"maxErrorTicks"`
+	MeanErrorTicks      float64 `json:"meanErrorTicks"`
+	MaxErrorUnits       float64 `json:"maxErrorUnits"` // in 64th notes
+	DroppedNotes        int     `json:"droppedNotes"`  // notes swallowed by the following note
+	// notes whose duration changed, in the order they start
+	AdjustedNotes []QuantizedNote `json:"adjustedNotes,omitempty"`
+}
+
+// QuantizedNote : a MIDI note whose duration changed when it was snapped to Motivic duration units
+type QuantizedNote struct {
+	Key              int     `json:"key"`
+	StartTick        int     `json:"startTick"`
+	DurationTicks    int     `json:"durationTicks"`
+	OriginalDuration float64 `json:"originalDuration"` // in 64th notes
+	Duration         int     `json:"duration"`         // in 64th notes, 0 when the note was dropped
 }
 
 // ConfigFrequencies :
@@ -145,10 +513,159 @@ type MotivicConfig struct {
 	Pitches     []Pitch           `json:"pitches"`
 }
 
+// Envelope : ADSR amplitude envelope applied to every note, times in milliseconds
+type Envelope struct {
+	Attack  float64 `json:"attack"`
+	Decay   float64 `json:"decay"`
+	Sustain float64 `json:"sustain"` // fraction of full scale (0-1)
+	Release float64 `json:"release"`
+}
+
+// EnvelopeOverride : envelope fields a request sets over the voice's default envelope, fields left out keep the default
+type EnvelopeOverride struct {
+	Attack  *float64 `json:"attack,omitempty"`
+	Decay   *float64 `json:"decay,omitempty"`
+	Sustain *float64 `json:"sustain,omitempty"`
+	Release *float64 `json:"release,omitempty"`
+}
+
+// oscillatorVoice : oscillator wave shape and its default envelope
+type oscillatorVoice struct {
+	WaveType generator.WaveType
+	Envelope Envelope
+	Pluck    *PluckedString // renders notes with the Karplus-Strong string model instead of the wave shape
+	FM       *FMVoice       // renders notes with FM operators instead of the wave shape
+}
+
+// FMVoice : frequency modulation synthesizer of 2 to 4 sine operators
+type FMVoice struct {
+	Operators []FMOperator `json:"operators"`
+}
+
+// FMOperator : sine oscillator of an FM voice, heard when it is a carrier or modulating the phase of an earlier operator
+type FMOperator struct {
+	Ratio     float64  `json:"ratio"`               // frequency as a multiple of the note's
+	Index     float64  `json:"index"`               // level (0-1) of a carrier, or modulation index in radians of a modulator
+	Envelope  Envelope `json:"envelope"`            // level of the operator over the note
+	Modulates *int     `json:"modulates,omitempty"` // index of the operator this one modulates, carriers leave it out
+	Feedback  float64  `json:"feedback,omitempty"`  // how much the operator modulates itself (0-1)
+}
+
+// PluckedString : Karplus-Strong string model settings of the plucked voices
+type PluckedString struct {
+	Damping    float64 `json:"damping"`    // 0 rings for as long as the note lasts, 1 dies away almost at once
+	Brightness float64 `json:"brightness"` // 0 plucks softly with a dark tone, 1 sharply with a bright tone
+}
+
+// fileFormat : file extension and MIME type of an output format
+type fileFormat struct {
+	Extension string
+	MIMEType  string
+}
+
+// RenderOptions : sample rate, bit depth and channel count of rendered audio, unset fields default to 16/44/mono
+type RenderOptions struct {
+	SampleRate   int    `json:"sampleRate"`
+	BitDepth     int    `json:"bitDepth"`
+	Channels     int    `json:"channels"`     // every channel carries the same mono signal
+	SampleFormat string `json:"sampleFormat"` // "int" (default) or "float" (WAV only)
+}
+
 // JSONConversionRequestBody : API signature to generate a binary from JSON
 type JSONConversionRequestBody struct {
-	Motif Motif  `json:"motif"`
-	Voice string `json:"voice"`
+	Motif    Motif             `json:"motif"`
+	Voice    string            `json:"voice"`
+	Format   string            `json:"format"`             // "wav" (default), "aiff", "flac" or "midi"
+	Envelope *EnvelopeOverride `json:"envelope,omitempty"` // overrides fields of the voice's default envelope
+	Pluck    *PluckedString    `json:"pluck,omitempty"`    // overrides the string settings of plucked voices
+	FM       *FMVoice          `json:"fm,omitempty"`       // custom FM voice played instead of the voice
+	Render   RenderOptions     `json:"render"`
+}
+
+// voiceSettings : voice a motif is rendered with and the request's overrides of its defaults
+type voiceSettings struct {
+	Name     string
+	Envelope *EnvelopeOverride // overrides fields of the voice's default envelope
+	Pluck    *PluckedString    // overrides the string settings of plucked voices
+	FM       *FMVoice          // custom FM voice played instead of the named voice
+	Sampler  *Sampler          // uploaded samples played instead of the named voice
+}
+
+// Sampler : voice playing uploaded WAV samples, each mapped to a range of keys and velocities
+type Sampler struct {
+	Regions []*SamplerRegion
+}
+
+// SamplerRegion : a sample and the notes it plays, set by an SFZ-style sample map or the sample's own metadata
+type SamplerRegion struct {
+	Sample        string  // file name of the uploaded sample
+	KeyCenter     int     // MIDI key the sample sounds at its recorded pitch
+	LoKey, HiKey  int     // lowest and highest MIDI key the region plays
+	LoVel, HiVel  int     // lowest and highest MIDI velocity the region plays
+	Tune          float64 // cents
+	Volume        float64 // dB
+	LoopMode      string  // no_loop, one_shot, loop_continuous or loop_sustain
+	LoopStart     int     // first frame of the loop, -1 to use the sample's loop
+	LoopEnd       int     // frame after the loop, -1 to use the sample's loop
+	LoopCrossfade float64 // seconds of the loop's end faded into its start
+	Release       float64 // seconds the sample keeps sounding after the note ends
+	sample        *wavSample
+}
+
+// wavSample : mono samples of an uploaded WAV file and the sampler metadata of its smpl chunk
+type wavSample struct {
+	Data       []float64
+	SampleRate int
+	RootKey    int // MIDI unity note, -1 when the file doesn't have one
+	LoopStart  int
+	LoopEnd    int // frame after the loop, 0 when the file has no loop
+}
+
+// MixLayer : a motif of a mixdown with its own voice, level, stereo position and start
+type MixLayer struct {
+	Motif    Motif             `json:"motif"`
+	Voice    string            `json:"voice"`
+	Envelope *EnvelopeOverride `json:"envelope,omitempty"` // overrides fields of the voice's default envelope
+	Pluck    *PluckedString    `json:"pluck,omitempty"`    // overrides the string settings of plucked voices
+	FM       *FMVoice          `json:"fm,omitempty"`       // custom FM voice played instead of the voice
+	GainDB   float64           `json:"gainDb"`             // level of the layer, 0 leaves it at full scale
+	Pan      float64           `json:"pan"`                // -1 (left) to 1 (right), ignored for mono output
+	Offset   int               `json:"offset"`             // start of the layer in 64th notes, at the tempo of its motif
+}
+
+// MixdownRequestBody : API signature to render layered motifs into a single file
+type MixdownRequestBody struct {
+	Name       string        `json:"name"`
+	Layers     []MixLayer    `json:"layers"`
+	Format     string        `json:"format"`               // "wav" (default), "aiff" or "flac"
+	Render     RenderOptions `json:"render"`               // channels default to stereo
+	HeadroomDB *float64      `json:"headroomDb,omitempty"` // how far below full scale the mix may peak, defaults to defaultMixHeadroomDB
+	Stems      bool          `json:"stems"`                // also return every layer as a file of its own
+}
+
+// midiEvent : MIDI channel or meta message at an absolute tick position
+type midiEvent struct {
+	Tick int
+	Data []byte
+}
+
+// midiTrack : ordered MIDI events of one Standard MIDI File track
+type midiTrack []midiEvent
+
+// decodedMIDIFile : header fields and tracks of a Standard MIDI File
+type decodedMIDIFile struct {
+	Format   int
+	Division int // ticks per quarter note
+	Tracks   []midiTrack
+}
+
+// midiNote : a sounding MIDI note at absolute tick positions
+type midiNote struct {
+	Channel  int
+	Key      int
+	Velocity int
+	Start    int
+	Duration int
 }
 
 var notes = []string{
@@ -322,8 +839,8 @@ func Index(vs []string, t string) int {
 
 func getNoteNameAndOctave(value int) (string, int) {
 	// notes with negative value are rests
-	if value < 0 {
-		return "", -1
+	if value < 1 {
+		return restName, -1
 	}
 	note := config.Pitches[value-1]
 	return note.Name, note.Octave
@@ -332,12 +849,15 @@ func getNoteNameAndOctave(value int) (string, int) {
 func getPitchFrequency(pitch string, octave int) float64 {
 	fmt.Println("Motivic Config...")
 	fmt.Println(config)
-	// handle rests - where pitch and octave are falsey
-	if pitch == "" || pitch == "rest" {
+	// rests never reach the oscillator, but don't index the frequency table with them
+	if pitch == "" || pitch == restName || octave < 0 || octave >= len(config.Frequencies) {
 		return 0.00
 	}
 	fmt.Printf("note pitch: %v\n", pitch)
 	idx := Index(config.Notes, pitch)
+	if idx < 0 {
+		return 0.00
+	}
 	fmt.Printf("note index: %v\n", idx)
 	freq := config.Frequencies[octave][idx]
 	fmt.Printf("note freq: %v\n", freq)
@@ -364,392 +884,2949 @@ func initMotivicConfig() {
 	config = c
 }
 
+// tempo units count beats of the time signature's note value (ts[1]), like the web app
 func getDurationInSeconds(dur int, t Tempo, ts TimeSignature) float64 {
 	beatsPerSec := float64(t.Units) / float64(60)
 	secsPerBeat := float64(1) / float64(beatsPerSec)
-	beatsPerNote := float64(dur) / float64(ts[0]*ts[1])
+	unitsPerBeat := float64(motivicUnitsPerQuarterNote*4) / float64(ts[1])
+	beatsPerNote := float64(dur) / unitsPerBeat
 	durSecs := secsPerBeat * beatsPerNote
 	return float64(durSecs)
 }
 
-func convertMIDIFileToWAVFile(inputFileName string, outputFilePath string, wf string, c chan<- bool) {
-	success := false
+// take a span of the motif and return its length in seconds, following the tempo map
+func getMotifDurationInSeconds(meta Meta, startingBeat int, dur int) float64 {
+	secs := 0.0
+	end := startingBeat + dur
+	for pos := startingBeat; pos < end; {
+		t, ts, next := getMetaAtBeat(meta, pos)
+		if next > end {
+			next = end
+		}
+		secs += getDurationInSeconds(next-pos, t, ts)
+		pos = next
+	}
+	return secs
+}
+
+// take a position of the motif and return the tempo and time signature in effect there,
+// as well as the position of the next change
+func getMetaAtBeat(meta Meta, beat int) (Tempo, TimeSignature, int) {
+	t := meta.Tempo
+	ts := meta.TimeSignature
+	next := math.MaxInt32
+	for _, c := range meta.TempoChanges {
+		if c.StartingBeat <= beat {
+			t = c.Tempo
+		} else if c.StartingBeat < next {
+			next = c.StartingBeat
+		}
+	}
+	for _, c := range meta.TimeSignatureChanges {
+		if c.StartingBeat <= beat {
+			ts = c.TimeSignature
+		} else if c.StartingBeat < next {
+			next = c.StartingBeat
+		}
+	}
+	return t, ts, next
+}
+
+func convertMIDIFileToAudioFile(ctx context.Context, midiData []byte, outputFile io.WriteSeeker, format string, voice voiceSettings, opts RenderOptions, c chan<- error) {
 	// parse the MIDI file to Motivic format
-	motifs, err := parseMIDIFile(inputFileName)
-	if err != nil || len(motifs) == 0 {
-		errMsg := fmt.Sprint("ERROR: parseMIDIFile() ", err)
-		fmt.Println(errMsg)
-		c <- success
-		return
+	motifs, err := parseMIDIFile(ctx, midiData)
+	if err == nil && len(motifs) == 0 {
+		err = errors.New("MIDI file contains no notes")
 	}
-	// for now Motivic only supports monophonic melodies so just grab the first track
-	if len(motifs) > 1 {
-		fmt.Println("ERROR: MIDI file is not monophonic")
-		c <- success
+	if err != nil {
+		fmt.Println("ERROR: parseMIDIFile()", err)
+		c <- newConversionError(errCodeParseFailed, err)
 		return
 	}
-	motif := motifs[0]
-
-	for _, n := range motif.Notes {
-		fmt.Printf("MOTIF NOTE:\t%+v\n", n)
+	for _, motif := range motifs {
+		for _, n := range motif.Notes {
+			fmt.Printf("MOTIF NOTE:\t%+v\n", n)
+		}
 	}
 
-	// convert Motif to audio buffers
-	motifBuffers := motifAudioMap(motif, wf)
-	// ignore error if dir already exists
-	_ = os.Mkdir(outputFileDir, 0777)
-	// generate the audio file
-	outputFile, err := os.Create(outputFilePath)
+	// convert Motifs to audio buffers, layering the voices of polyphonic files
+	motifBuffers, err := mixMotifAudio(ctx, motifs, voice, opts)
 	if err != nil {
-		fmt.Println("ERROR:", err)
-		c <- success
+		fmt.Println("ERROR: mixMotifAudio", err)
+		c <- newConversionError(errCodeSynthesisFailed, err)
 		return
 	}
-	defer outputFile.Close()
-	if err := encodeAudioFile(wavFile, motifBuffers, outputFile); err != nil {
+	// generate the audio file
+	if err := encodeAudioFile(ctx, format, motifBuffers, outputFile, opts); err != nil {
 		fmt.Println("ERROR: encodeAudioFile", err)
-		c <- success
+		c <- newConversionError(errCodeEncodingFailed, err)
 		return
 	}
-	fmt.Println("Audio file generated at", outputFilePath)
-	c <- true
+	fmt.Println("Audio file generated")
+	c <- nil
 	return
 }
 
-func convertMotifToWAVFile(motif Motif, outputFilePath string, wf string, c chan<- bool) {
-	success := false
-
+func convertMotifToAudioFile(ctx context.Context, motif Motif, outputFile io.WriteSeeker, format string, voice voiceSettings, opts RenderOptions, c chan<- error) {
 	for _, n := range motif.Notes {
 		fmt.Printf("MOTIF NOTE:\t%+v\n", n)
 	}
 
 	// convert Motif to audio buffers
-	motifBuffers := motifAudioMap(motif, wf)
-	// ignore error if dir already exists
-	_ = os.Mkdir(outputFileDir, 0777)
-	// generate the audio file
-	outputFile, err := os.Create(outputFilePath)
+	motifBuffers, err := motifAudioMap(ctx, motif, voice, opts)
 	if err != nil {
-		fmt.Println("ERROR:", err)
-		c <- success
+		fmt.Println("ERROR: motifAudioMap", err)
+		c <- newConversionError(errCodeSynthesisFailed, err)
 		return
 	}
-	defer outputFile.Close()
-	if err := encodeAudioFile(wavFile, motifBuffers, outputFile); err != nil {
+	// generate the audio file
+	if err := encodeAudioFile(ctx, format, motifBuffers, outputFile, opts); err != nil {
 		fmt.Println("ERROR: encodeAudioFile", err)
-		c <- success
+		c <- newConversionError(errCodeEncodingFailed, err)
 		return
 	}
-	fmt.Println("Audio file generated at", outputFilePath)
-	c <- true
+	fmt.Println("Audio file generated")
+	c <- nil
 	return
 }
 
-// take a JSON file on disk and return parsed music events (Motivic.Motif format)
-func parseJSONFile(filePath string) ([]Motif, error) {
-	var parsedTracks []Motif
-	var err error = nil
-	defer func() {
-		if panicErr := recover(); panicErr != nil {
-			fmt.Println("Recovered in parseJSONFile", panicErr)
-			parsedTracks = nil
-			err = errors.New("JSON file failed to parse")
-		}
-	}()
-	file, err := os.Open(filePath)
-	if err != nil {
-		return parsedTracks, err
+func convertMotifToMIDIFile(ctx context.Context, motif Motif, outputFile io.Writer, c chan<- error) {
+	if err := ctx.Err(); err != nil {
+		c <- err
+		return
 	}
-	defer file.Close()
-
-	decoder := json.NewDecoder(file)
-
-	parsedJSON := []map[string]interface{}{}
-
-	// Read the array open bracket
-	decoder.Token()
-
-	data := map[string]interface{}{}
-	for decoder.More() {
-		decoder.Decode(&data)
-		parsedJSON = append(parsedJSON, data)
+	// convert Motif to a MIDI track
+	track := motifMIDIMap(motif)
+	// generate the MIDI file
+	if err := encodeMIDIFile([]midiTrack{track}, outputFile); err != nil {
+		fmt.Println("ERROR: encodeMIDIFile", err)
+		c <- newConversionError(errCodeEncodingFailed, err)
+		return
 	}
-	// TODO: convert parsed JSON to Motif tracks
-	return parsedTracks, err
+	fmt.Println("MIDI file generated")
+	c <- nil
+	return
 }
 
-// take a MIDI file on disk and return parsed music events (Motivic.Motif format)
-func parseMIDIFile(filePath string) ([]Motif, error) {
-	var parsedTracks []Motif
-	var err error = nil
-	defer func() {
-		if panicErr := recover(); panicErr != nil {
-			fmt.Println("Recovered in parseMIDIFile", panicErr)
-			parsedTracks = nil
-			err = errors.New("MIDI file failed to parse")
-		}
-	}()
-	file, err := os.Open(filePath)
+func convertFileToJSONFile(ctx context.Context, inputFileName string, inputData []byte, outputFile io.Writer, motifName string, c chan<- error) {
+	// parse the MIDI or JSON file to Motivic format
+	motifs, err := parseUploadedFile(ctx, inputFileName, inputData)
+	if err == nil && len(motifs) == 0 {
+		err = errors.New("file contains no motifs")
+	}
 	if err != nil {
-		return parsedTracks, err
+		fmt.Println("ERROR: parseUploadedFile()", err)
+		c <- newConversionError(errCodeParseFailed, err)
+		return
 	}
-	defer file.Close()
-	decodedFile := midi.NewDecoder(file)
-	if err := decodedFile.Parse(); err != nil {
-		return parsedTracks, err
+	jsonData, err := motifJSONMap(getNamedMotifs(motifs, motifName, getUploadedFileType(inputFileName)))
+	if err != nil {
+		fmt.Println("ERROR: motifJSONMap", err)
+		c <- newConversionError(errCodeEncodingFailed, err)
+		return
+	}
+	if err := encodeJSONFile(jsonData, outputFile); err != nil {
+		fmt.Println("ERROR: encodeJSONFile", err)
+		c <- newConversionError(errCodeEncodingFailed, err)
+		return
 	}
+	fmt.Println("JSON file generated")
+	c <- nil
+	return
+}
 
-	for _, t := range decodedFile.Tracks {
-		parsedTrack, err := parseMIDITrack(t)
-		if err != nil {
-			fmt.Println("ERROR parsing track", err)
-			return parsedTracks, err
+// mix rendered layers and write the mix, and the stem of every layer when stemFiles is set
+func convertLayersToAudioFiles(ctx context.Context, layers []MixLayer, layerData [][]float64, mixFile io.WriteSeeker, stemFiles []*memoryFile, format string, headroomDB float64, opts RenderOptions, c chan<- error) {
+	mix, stems := mixLayers(layers, layerData, stemFiles != nil, headroomDB, opts)
+	if err := encodeAudioFile(ctx, format, []audio.FloatBuffer{{Data: mix, Format: opts.format()}}, mixFile, opts); err != nil {
+		fmt.Println("ERROR: encodeAudioFile", err)
+		c <- newConversionError(errCodeEncodingFailed, err)
+		return
+	}
+	for i, f := range stemFiles {
+		if err := encodeAudioFile(ctx, format, []audio.FloatBuffer{{Data: stems[i], Format: opts.format()}}, f, opts); err != nil {
+			fmt.Println("ERROR: encodeAudioFile", err)
+			c <- newConversionError(errCodeEncodingFailed, err)
+			return
 		}
-		parsedTracks = append(parsedTracks, parsedTrack)
 	}
-	return parsedTracks, err
+	fmt.Println("Mixdown generated")
+	c <- nil
+	return
 }
 
-func printReflectionInfo(t *midi.Track) {
-	// expect CustomStruct if non pointer
-	fmt.Println("Actual type is:", reflect.TypeOf(t))
-
-	// expect struct if non pointer
-	fmt.Println("Value type is:", reflect.ValueOf(t).Kind())
+// conversion : output files of a validated conversion request and the steps that render them
+type conversion struct {
+	Name  string // name of the zip file holding the output files
+	Files []*memoryFile
+	Steps []conversionStep
+}
 
-	if reflect.ValueOf(t).Kind() == reflect.Ptr {
-		// expect: CustomStruct
-		fmt.Println("Indirect type is:", reflect.Indirect(reflect.ValueOf(t)).Kind()) // prints interface
+// conversionStep : one unit of a conversion's work, named for progress and timeout diagnostics
+type conversionStep struct {
+	Name string
+	Run  func(ctx context.Context, c chan<- error)
+}
 
-		// expect: struct
-		fmt.Println("Indirect value type is:", reflect.Indirect(reflect.ValueOf(t)).Kind()) // prints interface
-	}
+// renderTimeoutError : a conversion cut short by its deadline or a client disconnect, with how far it got
+type renderTimeoutError struct {
+	Err       error
+	Elapsed   time.Duration
+	Completed []string // steps done before the conversion stopped
+	Stopped   string   // step running when the conversion stopped
+	Total     int
+}
 
-	fmt.Println("")
+func (e *renderTimeoutError) Error() string {
+	return fmt.Sprintf("rendering stopped after %v in %v with %d of %d steps done %v: %v",
+		e.Elapsed.Round(time.Millisecond), e.Stopped, len(e.Completed), e.Total, e.Completed, e.Err)
 }
 
-func parseMIDITrack(track *midi.Track) (Motif, error) {
-	// serialize midi.Track to Motivic.Motif
-	// TODO: remove hardcoded time signature - parse from MIDI file
-	fmt.Printf("\n*midi.Track: \t%+v\n\n", track)
-	printReflectionInfo(track)
-	m := Motif{}
-	if track == nil {
-		return m, fmt.Errorf("ERROR: parseMIDITrack() - track is nil")
-	}
-	bpm := track.Events[0].Bpm
-	t := Tempo{Type: "bpm", Units: int(bpm)}
-	ts := TimeSignature{4, 4}
-	var parsedEvents []MotifNote
-	for _, e := range track.AbsoluteEvents() {
-		parsedEvent, err := parseMIDIEvent(e)
-		if err != nil {
-			fmt.Println(err)
-			return m, err
-		}
-		parsedEvents = append(parsedEvents, parsedEvent)
-	}
-	parsedEvents = getNotesWithInsertedRests(parsedEvents)
-	meta := Meta{Tempo: t, TimeSignature: ts}
-	m = Motif{Notes: parsedEvents, Meta: meta}
-	return m, nil
+func (e *renderTimeoutError) Unwrap() error {
+	return e.Err
 }
 
-func getNotesWithInsertedRests(events []MotifNote) []MotifNote {
-	// MIDI doesn't treat rests as events so
-	// fabricate rest notes to fill in the gaps in parsedEvents
-	var notes []MotifNote
-	for i, e := range events {
-		beatPosition := 1
-		if i != 0 {
-			// this is the first event
-			prevNote := events[i-1]
-			beatPosition = prevNote.StartingBeat + prevNote.Duration
-		}
-		// this is not the first event
-		if e.StartingBeat != beatPosition {
-			// there is a gap where a rest should go
-			// for now, Note with negative value is a Rest
-			rest := newNote(-1, e.StartingBeat-beatPosition)
-			mn := MotifNote{
-				Note:         rest,
-				StartingBeat: beatPosition,
+// run the conversion's steps in order until the context ends
+func (cv conversion) render(ctx context.Context) error {
+	tsStarted := time.Now()
+	var completed []string
+	for _, step := range cv.Steps {
+		// buffered so an abandoned step never blocks on its result
+		c := make(chan error, 1)
+		go func() {
+			// a panicking step fails the conversion instead of the whole instance
+			defer func() {
+				if r := recover(); r != nil {
+					c <- fmt.Errorf("conversion step panicked: %v", r)
+				}
+			}()
+			step.Run(ctx, c)
+		}()
+		var err error
+		select {
+		case err = <-c:
+		case <-ctx.Done():
+			// give the step a moment to report where it stopped
+			select {
+			case err = <-c:
+			case <-time.After(renderCancelGracePeriod):
+				err = ctx.Err()
 			}
-			// Insert the rest before this note
-			notes = append(notes, mn)
 		}
-		// there is no gap so add the note
-		notes = append(notes, e)
+		if err != nil && ctx.Err() != nil {
+			return &renderTimeoutError{Err: err, Elapsed: time.Since(tsStarted), Completed: completed, Stopped: step.Name, Total: len(cv.Steps)}
+		}
+		if err != nil {
+			return err
+		}
+		completed = append(completed, step.Name)
 	}
-	return notes
-}
-
-// converts MIDI event.MIDINote to Motivic.Note.value
-func convertMIDINote(note int) int {
-	return note + midiNoteValueOffset
-}
-
-func convertMIDINoteDuration(dur int) int {
-	return dur / midiDurationValueDivisor
+	return nil
 }
 
-func parseMIDIEvent(e *midi.AbsEv) (MotifNote, error) {
-	// TODO: serialize midi.Event to Motivic.Note
-	fmt.Printf("MIDI EVENT:\t%+v\n", e)
-	// TODO: make sure conversion from MIDINote to MotifNote.value is correct!
-	// TODO: handle RESTS!!!
-	value := convertMIDINote(e.MIDINote)
-	// TODO: conversion from ticks to MotifNote.duration is correct!
-	// TODO: make sure that these are always both ints!
-	duration := convertMIDINoteDuration(e.Duration)
-	n := newNote(value, duration)
-	mn := MotifNote{
-		Note: n,
-		// TODO: make sure this conversion from ticks to MotifNote.startingBeat is correct
-		// TODO: make sure that these are always both ints!
-		StartingBeat: convertMIDINoteDuration(e.Start) + 1,
+// return how long a conversion may run before it's cancelled
+func getMaxRenderTime() time.Duration {
+	secs, err := strconv.ParseInt(os.Getenv(maxRenderTimeEnv), 10, 64)
+	if err != nil || secs <= 0 {
+		secs = defaultMaxRenderSecs
 	}
-	return mn, nil
+	return time.Second * time.Duration(secs)
 }
 
-// take motif and return slice of audio buffers
-func motifAudioMap(m Motif, voice string) []audio.FloatBuffer {
-	fmt.Println("mapping Motif to audio buffers")
-	var buffers []audio.FloatBuffer
-	for _, n := range m.Notes {
-		fmt.Printf("Note: %v\n", n)
-		freq := getPitchFrequency(n.Name, n.Octave)
-		fmt.Printf("note: %v octave: %v frequency %v\n", freq, n.Name, n.Octave)
-		// TODO: duration needs to be converted to seconds?
-		// TODO: fix this - right now am rounding up to nearest second
-		ds := getDurationInSeconds(n.Duration, m.Meta.Tempo, m.Meta.TimeSignature)
-		fmt.Printf("duration in seconds: %v\n", ds)
-		fmt.Println("AUDIO NOTE DATA:", n.Name, n.Octave, n.Pitch, "freq:", freq, "secs:", ds)
-		// TODO: handle rests!!!
-		buf := generateAudioFrequency(freq, ds, voice)
-		buffers = append(buffers, *buf)
+// imported motifs are named after their source file like the web app does
+func getNamedMotifs(motifs []Motif, name string, fileType string) []Motif {
+	var named []Motif
+	for _, m := range motifs {
+		if m.Name == "" {
+			m.Name = name + "_" + fileType + "-import"
+		}
+		named = append(named, m)
 	}
-	return buffers
+	return named
 }
 
-// take motif and return slice of MIDI buffers
-func motifMIDIMap(m Motif) {
-	// TODO: write this
+// ValidationError : a problem with a Motif, pointing at the offending field and note
+type ValidationError struct {
+	Field     string // path of the offending field, relative to the validated value
+	NoteIndex int    // -1 when the problem isn't with a note
+	Message   string
 }
 
-// take motif and return JSON representation
-func motifJSONMap(m Motif) {
-	// TODO: write this
+func (e ValidationError) Error() string {
+	return fmt.Sprintf("%v %v", e.Field, e.Message)
 }
 
-// take frequency, duration, bit depth, and sample rate and return audio buffer of one note
-func generateAudioFrequency(freq float64, durSecs float64, voice string) *audio.FloatBuffer {
-	wf := waveForm[voice]
-	if wf == 0 {
-		wf = defaultWaveForm
+// ValidationErrors : every problem found by a Validate method, nil when there are none
+type ValidationErrors []ValidationError
+
+func (errs ValidationErrors) Error() string {
+	var msgs []string
+	for _, e := range errs {
+		msgs = append(msgs, e.Error())
 	}
-	osc := generator.NewOsc(wf, float64(freq), audioSampleRate)
-	// our osc generates values from -1 to 1, we need to go back to PCM scale
-	factor := float64(audio.IntMaxSignedValue(audioBitDepth))
-	osc.Amplitude = factor
-	// buf.Data slice has length bitDepth * seconds
-	data := make([]float64, int(math.Ceil(float64(audioSampleRate)*durSecs)))
-	buf := &audio.FloatBuffer{Data: data, Format: audioFormat}
-	osc.Fill(buf)
-	return buf
+	return strings.Join(msgs, "; ")
 }
 
-func encodeWAVFile(bufs []audio.FloatBuffer, w io.WriteSeeker) error {
-	// APPROACH: iterate through buffers and encode each one sequentially
-	e := wav.NewEncoder(w, bufs[0].PCMFormat().SampleRate, audioBitDepth, bufs[0].PCMFormat().NumChannels, 1)
-	for _, b := range bufs {
-		err := e.Write(b.AsIntBuffer())
-		if err != nil {
-			return err
-		}
+// return the problems with their fields nested under prefix, e.g. "motif." or "[2]."
+func (errs ValidationErrors) withPrefix(prefix string) ValidationErrors {
+	var nested ValidationErrors
+	for _, e := range errs {
+		e.Field = prefix + e.Field
+		nested = append(nested, e)
 	}
-	return e.Close()
+	return nested
 }
 
-func encodeAIFFile(bufs []audio.FloatBuffer, w io.WriteSeeker) error {
-	e := aiff.NewEncoder(w,
-		bufs[0].PCMFormat().SampleRate,
-		audioBitDepth,
-		bufs[0].PCMFormat().NumChannels)
-	for _, b := range bufs {
-		err := e.Write(b.AsIntBuffer())
-		if err != nil {
-			return err
+// Validate : check the fields the renderer depends on, returning every problem found
+func (m Motif) Validate() ValidationErrors {
+	errs := m.Meta.Validate().withPrefix("meta.")
+	if len(m.Notes) == 0 {
+		errs = append(errs, ValidationError{"notes", -1, "must not be empty"})
+	}
+	for i, n := range m.Notes {
+		for _, e := range n.Validate().withPrefix(fmt.Sprintf("notes[%d].", i)) {
+			e.NoteIndex = i
+			errs = append(errs, e)
 		}
 	}
-	return e.Close()
+	return errs
 }
 
-// take slice of audio buffers and write audio file
-func encodeAudioFile(format string, bufs []audio.FloatBuffer, w io.WriteSeeker) error {
-	switch format {
-	case "wav":
-		return encodeWAVFile(bufs, w)
-	case "aiff":
-		return encodeAIFFile(bufs, w)
-	default:
-		return errors.New("unknown format")
+// ValidateMIDI : check the notes fit in a Standard MIDI File, whose keys stop short of the top of the Motivic range
+func (m Motif) ValidateMIDI() ValidationErrors {
+	var errs ValidationErrors
+	for i, n := range m.Notes {
+		if key := n.Value - midiNoteValueOffset; !n.isRest() && key > midiMaxKey {
+			msg := fmt.Sprintf("%d is MIDI key %d, above the highest MIDI key (%d)", n.Value, key, midiMaxKey)
+			errs = append(errs, ValidationError{fmt.Sprintf("notes[%d].value", i), i, msg})
+		}
 	}
+	return errs
 }
 
-func encodeMIDIFile(bufs []audio.FloatBuffer, w io.WriteSeeker) {
-	// TODO: write this
-}
-
-func encodeJSONFile(jsonData []byte, filePath string) {
-	// TODO: write this
-	file, _ := os.OpenFile(filePath, os.O_CREATE, os.ModePerm)
-	defer file.Close()
-	encoder := json.NewEncoder(file)
-	encoder.Encode(jsonData)
-}
-
-func getRandomString(length int) string {
-	rand.Seed(time.Now().UnixNano())
-	chars := []rune("ABCDEFGHIJKLMNOPQRSTUVWXYZ" +
-		"abcdefghijklmnopqrstuvwxyz" +
-		"0123456789")
+// Validate : check the tempo and meter the renderer times notes with, returning every problem found
+func (m Meta) Validate() ValidationErrors {
+	var errs ValidationErrors
+	validateTempo := func(field string, t Tempo) {
+		if t.Type != "" && t.Type != "bpm" {
+			errs = append(errs, ValidationError{field + ".type", -1, fmt.Sprintf("%q is not supported, use \"bpm\"", t.Type)})
+		}
+		if t.Units <= 0 {
+			errs = append(errs, ValidationError{field + ".units", -1, "must be greater than 0"})
+		}
+	}
+	validateTimeSignature := func(field string, ts TimeSignature) {
+		switch {
+		case len(ts) != 2 || ts[0] <= 0 || ts[1] <= 0:
+			errs = append(errs, ValidationError{field, -1, "must be two positive integers"})
+		case ts[0] > 255:
+			errs = append(errs, ValidationError{field, -1, "must not have more than 255 beats"})
+		// MIDI files store the denominator as a power of two
+		case ts[1]&(ts[1]-1) != 0:
+			errs = append(errs, ValidationError{field, -1, fmt.Sprintf("denominator %d is not a power of two", ts[1])})
+		}
+	}
+	// MIDI tempo events hold 24-bit microseconds per quarter note
+	validateMIDITempo := func(field string, t Tempo, ts TimeSignature) {
+		if t.Units <= 0 || len(ts) != 2 || ts[1] <= 0 {
+			return
+		}
+		if mpqn := getMIDIMicrosecondsPerQuarterNote(t, ts); mpqn < 1 || mpqn > midiMaxMicrosecondsPerQuarterNote {
+			errs = append(errs, ValidationError{field, -1, fmt.Sprintf("%d is too slow or too fast for a %d beat unit", t.Units, ts[1])})
+		}
+	}
+	if m.Key != "" && Index(notes, strings.ToLower(m.Key)) < 0 {
+		errs = append(errs, ValidationError{"key", -1, fmt.Sprintf("%q is not one of %v", m.Key, notes)})
+	}
+	validateTempo("tempo", m.Tempo)
+	validateTimeSignature("timeSignature", m.TimeSignature)
+	for i, c := range m.TempoChanges {
+		if c.StartingBeat < 1 {
+			errs = append(errs, ValidationError{fmt.Sprintf("tempoChanges[%d].startingBeat", i), -1, "must be 1 or greater"})
+		}
+		validateTempo(fmt.Sprintf("tempoChanges[%d].tempo", i), c.Tempo)
+	}
+	for i, c := range m.TimeSignatureChanges {
+		if c.StartingBeat < 1 {
+			errs = append(errs, ValidationError{fmt.Sprintf("timeSignatureChanges[%d].startingBeat", i), -1, "must be 1 or greater"})
+		}
+		validateTimeSignature(fmt.Sprintf("timeSignatureChanges[%d].timeSignature", i), c.TimeSignature)
+	}
+	// the tempo is written again wherever the tempo or the meter changes
+	validateMIDITempo("tempo.units", m.Tempo, m.TimeSignature)
+	for i, c := range m.TempoChanges {
+		_, ts, _ := getMetaAtBeat(m, c.StartingBeat)
+		validateMIDITempo(fmt.Sprintf("tempoChanges[%d].tempo.units", i), c.Tempo, ts)
+	}
+	for i, c := range m.TimeSignatureChanges {
+		t, _, _ := getMetaAtBeat(m, c.StartingBeat)
+		validateMIDITempo(fmt.Sprintf("timeSignatureChanges[%d].timeSignature", i), t, c.TimeSignature)
+	}
+	for i, d := range m.Dynamics {
+		field := fmt.Sprintf("dynamics[%d]", i)
+		if d.StartingBeat < 1 {
+			errs = append(errs, ValidationError{field + ".startingBeat", -1, "must be 1 or greater"})
+		} else if i > 0 && d.StartingBeat < m.Dynamics[i-1].StartingBeat {
+			errs = append(errs, ValidationError{field + ".startingBeat", -1, "must not be before the previous marking"})
+		}
+		if _, ok := dynamicVelocities[d.Marking]; ok {
+			continue
+		}
+		if d.Marking != crescendoMarking && d.Marking != decrescendoMarking {
+			errs = append(errs, ValidationError{field + ".marking", -1, fmt.Sprintf("%q is not one of %v, %q or %q", d.Marking, dynamicMarkings, crescendoMarking, decrescendoMarking)})
+			continue
+		}
+		if d.EndingBeat <= d.StartingBeat {
+			errs = append(errs, ValidationError{field + ".endingBeat", -1, "must be after startingBeat"})
+		}
+		if _, ok := dynamicVelocities[d.Target]; d.Target != "" && !ok {
+			errs = append(errs, ValidationError{field + ".target", -1, fmt.Sprintf("%q is not one of %v", d.Target, dynamicMarkings)})
+		}
+	}
+	return errs
+}
+
+// Validate : check the note's pitch and timing, returning every problem found
+func (n MotifNote) Validate() ValidationErrors {
+	var errs ValidationErrors
+	// rests have a null value in Motivic JSON and restValue in Go
+	switch {
+	case n.Value == 0:
+		errs = append(errs, ValidationError{"value", -1, "must not be 0, rests have a null value"})
+	case n.Value < restValue || n.Value > len(config.Pitches):
+		errs = append(errs, ValidationError{"value", -1, fmt.Sprintf("%d is out of range (1-%d)", n.Value, len(config.Pitches))})
+	case !n.isRest():
+		if n.Name != "" && n.Name != n.PitchName() {
+			errs = append(errs, ValidationError{"name", -1, fmt.Sprintf("%q doesn't match value %d", n.Name, n.Value)})
+		}
+		if n.Pitch != "" && n.Pitch != n.ScientificPitch() {
+			errs = append(errs, ValidationError{"pitch", -1, fmt.Sprintf("%q doesn't match value %d", n.Pitch, n.Value)})
+		}
+	}
+	if n.Duration <= 0 {
+		errs = append(errs, ValidationError{"duration", -1, "must be greater than 0"})
+	}
+	if n.Velocity < 0 || n.Velocity > midiMaxVelocity {
+		errs = append(errs, ValidationError{"velocity", -1, fmt.Sprintf("must be between 1 and %d, or 0 to follow the motif's dynamics", midiMaxVelocity)})
+	}
+	// notes without a position follow the previous note
+	if n.StartingBeat < 0 {
+		errs = append(errs, ValidationError{"startingBeat", -1, "must not be negative"})
+	}
+	return errs
+}
+
+// take motifs and return the problems of all of them, nested under their index
+func validateMotifs(motifs []Motif) error {
+	var errs ValidationErrors
+	for i, m := range motifs {
+		errs = append(errs, m.Validate().withPrefix(fmt.Sprintf("[%d].", i))...)
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// take a JSON file on disk and return parsed music events (Motivic.Motif format)
+func parseJSONFile(data []byte) (parsedTracks []Motif, err error) {
+	defer func() {
+		if panicErr := recover(); panicErr != nil {
+			fmt.Println("Recovered in parseJSONFile", panicErr)
+			parsedTracks = nil
+			err = errors.New("JSON file failed to parse")
+		}
+	}()
+
+	// Motivic.json files hold an array of motifs, but a single motif is accepted too
+	trimmed := bytes.TrimSpace(data)
+	if len(trimmed) > 0 && trimmed[0] == '{' {
+		var m Motif
+		err = json.Unmarshal(trimmed, &m)
+		parsedTracks = []Motif{m}
+	} else {
+		err = json.Unmarshal(trimmed, &parsedTracks)
+	}
+	if err != nil {
+		var unmarshalTypeError *json.UnmarshalTypeError
+		if errors.As(err, &unmarshalTypeError) {
+			return nil, &APIError{Status: http.StatusBadRequest, Code: errCodeInvalidValue, Field: unmarshalTypeError.Field,
+				Message: fmt.Sprintf("JSON file contains an invalid value for the %q field (at position %d)", unmarshalTypeError.Field, unmarshalTypeError.Offset)}
+		}
+		return nil, &APIError{Status: http.StatusBadRequest, Code: errCodeInvalidJSON, Message: fmt.Sprintf("JSON file is badly-formed: %v", err)}
+	}
+	if len(parsedTracks) == 0 {
+		return nil, newAPIError(http.StatusBadRequest, errCodeInvalidMotif, "JSON file contains no motifs")
+	}
+
+	if err := validateMotifs(parsedTracks); err != nil {
+		return nil, err
+	}
+	for i, m := range parsedTracks {
+		// clients may only send note values and durations
+		parsedTracks[i] = m.Normalized()
+	}
+	return parsedTracks, err
+}
+
+// take an uploaded file's name and contents and parse it according to its file type
+func parseUploadedFile(ctx context.Context, fileName string, data []byte) ([]Motif, error) {
+	if getUploadedFileType(fileName) == jsonFile {
+		return parseJSONFile(data)
+	}
+	return parseMIDIFile(ctx, data)
+}
+
+func getUploadedFileType(fileName string) string {
+	if strings.ToLower(path.Ext(fileName)) == ".json" {
+		return jsonFile
+	}
+	return midiFile
+}
+
+// take the contents of a MIDI file and return parsed music events (Motivic.Motif format)
+// every channel of every track becomes its own Motif, and overlapping notes
+// within a channel are split into separate monophonic voices
+func parseMIDIFile(ctx context.Context, data []byte) (parsedTracks []Motif, err error) {
+	defer func() {
+		if panicErr := recover(); panicErr != nil {
+			fmt.Println("Recovered in parseMIDIFile", panicErr)
+			parsedTracks = nil
+			err = errors.New("MIDI file failed to parse")
+		}
+	}()
+	decodedFile, err := decodeMIDIFile(bytes.NewReader(data))
+	if err != nil {
+		return parsedTracks, err
+	}
+
+	// tempo and meter usually live in a conductor track of their own
+	meta := getMIDIFileMeta(decodedFile.Tracks, decodedFile.Division)
+	var trackErrs ValidationErrors
+	for i, t := range decodedFile.Tracks {
+		if err := ctx.Err(); err != nil {
+			return nil, fmt.Errorf("stopped parsing at track %d of %d: %w", i+1, len(decodedFile.Tracks), err)
+		}
+		motifs, err := parseMIDITrack(t, meta, decodedFile.Division)
+		var errs ValidationErrors
+		if errors.As(err, &errs) {
+			// report the problems of every track at once
+			trackErrs = append(trackErrs, errs.withPrefix(fmt.Sprintf("tracks[%d].", i))...)
+			continue
+		}
+		if err != nil {
+			fmt.Println("ERROR parsing track", i, err)
+			return parsedTracks, err
+		}
+		parsedTracks = append(parsedTracks, motifs...)
+	}
+	if len(trackErrs) > 0 {
+		return nil, trackErrs
+	}
+	// notes outside the Motivic pitch range can't be rendered
+	if err := validateMotifs(parsedTracks); err != nil {
+		return nil, err
+	}
+	for i, m := range parsedTracks {
+		parsedTracks[i] = m.Normalized()
+	}
+	return parsedTracks, err
+}
+
+// take the tracks of a MIDI file and return the Motivic.Meta shared by all of them,
+// including the tempo map and any meter changes
+func getMIDIFileMeta(tracks []midiTrack, ticksPerQuarterNote int) Meta {
+	var events midiTrack
+	for _, track := range tracks {
+		for _, e := range track {
+			if isMIDIMetaEvent(e, 0x51) || isMIDIMetaEvent(e, 0x58) || isMIDIMetaEvent(e, 0x59) {
+				events = append(events, e)
+			}
+		}
+	}
+	sort.SliceStable(events, func(i, j int) bool { return events[i].Tick < events[j].Tick })
+
+	// MIDI files default to 120 bpm in 4/4
+	mpqn := microsecondsPerMinute / 120
+	ts := TimeSignature{4, 4}
+	meta := Meta{Tempo: Tempo{Type: "bpm", Units: 120}, TimeSignature: ts}
+	lastTempo := meta.Tempo
+	lastTS := meta.TimeSignature
+	keyFound := false
+	for i := 0; i < len(events); {
+		// apply all meta events sharing a tick before recording any change
+		tick := events[i].Tick
+		for ; i < len(events) && events[i].Tick == tick; i++ {
+			data := getMIDIMetaEventData(events[i])
+			switch events[i].Data[1] {
+			case 0x51:
+				if len(data) == 3 {
+					mpqn = int(data[0])<<16 | int(data[1])<<8 | int(data[2])
+				}
+			case 0x58:
+				if len(data) >= 2 && data[0] > 0 {
+					ts = TimeSignature{int(data[0]), 1 << data[1]}
+				}
+			case 0x59:
+				// Motivic melodies only have one key
+				if len(data) == 2 && !keyFound {
+					meta.Key, meta.Mode = getKeyFromMIDIKeySignature(int8(data[0]), data[1])
+					keyFound = true
+				}
+			}
+		}
+		t := Tempo{Type: "bpm", Units: getMotivicTempo(mpqn, ts)}
+		beat := convertMIDINoteDuration(tick, ticksPerQuarterNote) + 1
+		if beat == 1 {
+			meta.Tempo = t
+			meta.TimeSignature = ts
+		} else {
+			if ts[0] != lastTS[0] || ts[1] != lastTS[1] {
+				meta.TimeSignatureChanges = append(meta.TimeSignatureChanges, TimeSignatureChange{StartingBeat: beat, TimeSignature: ts})
+			}
+			if t.Units != lastTempo.Units {
+				meta.TempoChanges = append(meta.TempoChanges, TempoChange{StartingBeat: beat, Tempo: t})
+			}
+		}
+		lastTempo = t
+		lastTS = ts
+	}
+	return meta
+}
+
+// MIDI tempo is microseconds per quarter note, Motivic tempo counts beats of the time signature's note value
+func getMotivicTempo(mpqn int, ts TimeSignature) int {
+	quarterNotesPerMinute := float64(microsecondsPerMinute) / float64(mpqn)
+	return int(math.Round(quarterNotesPerMinute * float64(ts[1]) / 4))
+}
+
+// take MIDI key signature sharps (positive) or flats (negative) and the minor flag and return key and mode
+func getKeyFromMIDIKeySignature(sharpsOrFlats int8, minor byte) (string, string) {
+	// each sharp moves the major key a fifth up the circle of fifths
+	keyIdx := ((int(sharpsOrFlats)*7)%12 + 12) % 12
+	if minor == 1 {
+		return notes[(keyIdx+modeTonicOffsets["aeolian"])%12], "aeolian"
+	}
+	return notes[keyIdx], "ionian"
+}
+
+func parseMIDITrack(track midiTrack, meta Meta, ticksPerQuarterNote int) ([]Motif, error) {
+	// serialize midiTrack to Motivic.Motif (one per channel voice)
+	var motifs []Motif
+	trackName := ""
+	for _, e := range track {
+		if isMIDIMetaEvent(e, 0x03) {
+			trackName = string(getMIDIMetaEventData(e))
+			break
+		}
+	}
+	channelNotes := map[int][]midiNote{}
+	var channels []int
+	var errs ValidationErrors
+	for _, n := range getMIDITrackNotes(track) {
+		if _, ok := channelNotes[n.Channel]; !ok {
+			channels = append(channels, n.Channel)
+		}
+		channelNotes[n.Channel] = append(channelNotes[n.Channel], n)
+	}
+	sort.Ints(channels)
+	for _, ch := range channels {
+		// General MIDI channel 10 holds unpitched percussion
+		if ch == midiPercussionChannel {
+			fmt.Println("skipping percussion channel notes")
+			continue
+		}
+		voices := splitMIDIVoices(channelNotes[ch])
+		for v, voice := range voices {
+			var parsedEvents []MotifNote
+			var sources []midiNote
+			report := &QuantizationReport{TicksPerQuarterNote: ticksPerQuarterNote}
+			for _, n := range voice {
+				parsedEvent, err := parseMIDIEvent(n, ticksPerQuarterNote)
+				if e, ok := err.(ValidationError); ok {
+					fmt.Println(err)
+					errs = append(errs, e)
+					continue
+				}
+				if err != nil {
+					fmt.Println(err)
+					return motifs, err
+				}
+				report.addEvent(n.Start, parsedEvent.StartingBeat-1)
+				report.addEvent(n.Start+n.Duration, parsedEvent.StartingBeat-1+parsedEvent.Duration)
+				parsedEvents = append(parsedEvents, parsedEvent)
+				sources = append(sources, n)
+			}
+			parsedEvents = getQuantizedNotesWithoutOverlaps(parsedEvents, sources, report)
+			parsedEvents = getNotesWithInsertedRests(parsedEvents)
+			name := trackName
+			if len(channels) > 1 || len(voices) > 1 {
+				name = strings.TrimLeft(fmt.Sprintf("%v_ch%d_v%d", trackName, ch+1, v+1), "_")
+			}
+			motifs = append(motifs, Motif{Name: name, Notes: parsedEvents, Meta: meta, Quantization: report})
+		}
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return motifs, nil
+}
+
+// pair note on and note off events of a track into sounding notes
+func getMIDITrackNotes(track midiTrack) []midiNote {
+	var notes []midiNote
+	// open notes by channel and key, closed first in first out
+	open := map[int][]int{}
+	lastTick := 0
+	for _, e := range track {
+		lastTick = e.Tick
+		msgType := e.Data[0] & 0xF0
+		if msgType != 0x80 && msgType != 0x90 {
+			continue
+		}
+		channel := int(e.Data[0] & 0x0F)
+		key := int(e.Data[1])
+		velocity := int(e.Data[2])
+		openKey := channel<<8 | key
+		// note on with zero velocity is a note off
+		if msgType == 0x90 && velocity > 0 {
+			open[openKey] = append(open[openKey], len(notes))
+			notes = append(notes, midiNote{Channel: channel, Key: key, Velocity: velocity, Start: e.Tick})
+			continue
+		}
+		if len(open[openKey]) == 0 {
+			continue
+		}
+		idx := open[openKey][0]
+		open[openKey] = open[openKey][1:]
+		notes[idx].Duration = e.Tick - notes[idx].Start
+	}
+	// notes still sounding at the end of the track are cut off there
+	for _, idxs := range open {
+		for _, idx := range idxs {
+			notes[idx].Duration = lastTick - notes[idx].Start
+		}
+	}
+	return notes
+}
+
+// split notes of one channel into monophonic voices
+func splitMIDIVoices(notes []midiNote) [][]midiNote {
+	sorted := make([]midiNote, len(notes))
+	copy(sorted, notes)
+	// chord tones are assigned from the top down so the highest line is the first voice
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if sorted[i].Start != sorted[j].Start {
+			return sorted[i].Start < sorted[j].Start
+		}
+		return sorted[i].Key > sorted[j].Key
+	})
+	var voices [][]midiNote
+	for _, n := range sorted {
+		if n.Duration <= 0 {
+			continue
+		}
+		assigned := false
+		for v, voice := range voices {
+			last := voice[len(voice)-1]
+			if last.Start+last.Duration <= n.Start {
+				voices[v] = append(voice, n)
+				assigned = true
+				break
+			}
+		}
+		if !assigned {
+			voices = append(voices, []midiNote{n})
+		}
+	}
+	return voices
+}
+
+func getNotesWithInsertedRests(events []MotifNote) []MotifNote {
+	// MIDI doesn't treat rests as events so
+	// fabricate rest notes to fill in the gaps in parsedEvents
+	var notes []MotifNote
+	for i, e := range events {
+		beatPosition := 1
+		if i != 0 {
+			// this is the first event
+			prevNote := events[i-1]
+			beatPosition = prevNote.StartingBeat + prevNote.Duration
+		}
+		// this is not the first event
+		if e.StartingBeat != beatPosition {
+			// there is a gap where a rest should go
+			// Note with negative value is a Rest
+			rest := newNote(restValue, e.StartingBeat-beatPosition)
+			mn := MotifNote{
+				Note:         rest,
+				StartingBeat: beatPosition,
+			}
+			// Insert the rest before this note
+			notes = append(notes, mn)
+		}
+		// there is no gap so add the note
+		notes = append(notes, e)
+	}
+	return notes
+}
+
+// converts MIDI event.MIDINote to Motivic.Note.value
+func convertMIDINote(note int) int {
+	return note + midiNoteValueOffset
+}
+
+// converts MIDI ticks to the nearest Motivic duration unit (64th note) using the file's time division
+func convertMIDINoteDuration(ticks int, ticksPerQuarterNote int) int {
+	return int(math.Round(float64(ticks*motivicUnitsPerQuarterNote) / float64(ticksPerQuarterNote)))
+}
+
+func parseMIDIEvent(e midiNote, ticksPerQuarterNote int) (MotifNote, error) {
+	// serialize midiNote to Motivic.Note
+	fmt.Printf("MIDI EVENT:\t%+v\n", e)
+	value := convertMIDINote(e.Key)
+	// values below 1 are rests, so the lowest octave of MIDI keys has no Motivic pitch
+	if value < 1 {
+		msg := fmt.Sprintf("%d at tick %d is below c0, the lowest Motivic pitch", e.Key, e.Start)
+		return MotifNote{}, ValidationError{"key", -1, msg}
+	}
+	// note on and note off are quantized independently so errors don't accumulate
+	start := convertMIDINoteDuration(e.Start, ticksPerQuarterNote)
+	end := convertMIDINoteDuration(e.Start+e.Duration, ticksPerQuarterNote)
+	n := newNote(value, end-start)
+	n.Velocity = e.Velocity
+	mn := MotifNote{
+		Note:         n,
+		StartingBeat: start + 1,
+	}
+	return mn, nil
+}
+
+// quantization can shrink short notes to nothing or pull a note on ahead of the previous note off.
+// sources are the MIDI notes the events were parsed from, for reporting the notes that changed length.
+func getQuantizedNotesWithoutOverlaps(events []MotifNote, sources []midiNote, report *QuantizationReport) []MotifNote {
+	var notes []MotifNote
+	var kept []int // index of each note's source
+	for i, e := range events {
+		// notes shorter than half a 64th note are lengthened to one unit
+		if e.Duration < 1 {
+			e.Duration = 1
+		}
+		if len(notes) > 0 {
+			prev := &notes[len(notes)-1]
+			if prev.StartingBeat+prev.Duration > e.StartingBeat {
+				prev.Duration = e.StartingBeat - prev.StartingBeat
+			}
+			if prev.Duration < 1 {
+				report.addNote(sources[kept[len(kept)-1]], 0)
+				notes = notes[:len(notes)-1]
+				kept = kept[:len(kept)-1]
+				report.DroppedNotes++
+			}
+		}
+		notes = append(notes, e)
+		kept = append(kept, i)
+	}
+	for i, n := range notes {
+		report.addNote(sources[kept[i]], n.Duration)
+	}
+	sort.SliceStable(report.AdjustedNotes, func(i, j int) bool { return report.AdjustedNotes[i].StartTick < report.AdjustedNotes[j].StartTick })
+	return notes
+}
+
+// record a note whose quantized duration differs from its duration in ticks
+func (q *QuantizationReport) addNote(n midiNote, duration int) {
+	original := float64(n.Duration*motivicUnitsPerQuarterNote) / float64(q.TicksPerQuarterNote)
+	if float64(duration) == original {
+		return
+	}
+	q.AdjustedNotes = append(q.AdjustedNotes, QuantizedNote{Key: n.Key, StartTick: n.Start, DurationTicks: n.Duration, OriginalDuration: original, Duration: duration})
+}
+
+// record the distance between a MIDI tick position and its quantized Motivic position
+func (q *QuantizationReport) addEvent(tick int, unit int) {
+	quantizedTick := float64(unit*q.TicksPerQuarterNote) / float64(motivicUnitsPerQuarterNote)
+	diff := math.Abs(quantizedTick - float64(tick))
+	if diff > 0 {
+		q.QuantizedEvents++
+	}
+	q.MeanErrorTicks = (q.MeanErrorTicks*float64(q.Events) + diff) / float64(q.Events+1)
+	q.Events++
+	if diff > q.MaxErrorTicks {
+		q.MaxErrorTicks = diff
+		q.MaxErrorUnits = diff * float64(motivicUnitsPerQuarterNote) / float64(q.TicksPerQuarterNote)
+	}
+}
+
+// take motif and return slice of audio buffers
+// notes are rendered onto a running sample clock: every onset is computed from the
+// note's absolute position so rounding never accumulates, and one oscillator plays
+// every note so its phase carries across note boundaries
+func motifAudioMap(ctx context.Context, m Motif, voice voiceSettings, opts RenderOptions) ([]audio.FloatBuffer, error) {
+	fmt.Println("mapping Motif to audio buffers")
+	v, ok := waveForm[voice.Name]
+	if !ok {
+		v = waveForm[defaultVoice]
+	}
+	env, pluck, fm := voice.Envelope.over(v.Envelope), voice.Pluck, voice.FM
+	if pluck == nil {
+		pluck = v.Pluck
+	}
+	if fm == nil {
+		fm = v.FM
+	}
+	osc := &oscillator{shape: v.WaveType, sampleRate: opts.SampleRate}
+
+	positions := m.NoteStartingBeats()
+	endBeat := 1
+	for i, n := range m.Notes {
+		if positions[i]+n.Duration > endBeat {
+			endBeat = positions[i] + n.Duration
+		}
+	}
+	// sampled notes ring on after the motif's last note ends
+	tail := 0
+	if voice.Sampler != nil {
+		tail = voice.Sampler.getMaxReleaseSamples(opts.SampleRate)
+	}
+	data := make([]float64, getSamplePosition(m.Meta, endBeat, opts.SampleRate)+tail)
+
+	for i, n := range m.Notes {
+		if err := ctx.Err(); err != nil {
+			return nil, fmt.Errorf("stopped synthesis at note %d of %d: %w", i, len(m.Notes), err)
+		}
+		fmt.Printf("Note: %v\n", n)
+		start := getSamplePosition(m.Meta, positions[i], opts.SampleRate)
+		end := getSamplePosition(m.Meta, positions[i]+n.Duration, opts.SampleRate)
+		fmt.Printf("samples: %v-%v\n", start, end)
+		// rests are the silence already in the buffer
+		if n.isRest() {
+			fmt.Println("AUDIO REST DATA:", "samples:", end-start)
+			continue
+		}
+		freq := getPitchFrequency(n.PitchName(), n.PitchOctave())
+		fmt.Println("AUDIO NOTE DATA:", n.ScientificPitch(), "freq:", freq, "samples:", end-start)
+		startGain, endGain := m.noteGains(i, positions[i])
+		switch {
+		case voice.Sampler != nil:
+			velocity := m.NoteVelocity(i, positions[i])
+			if velocity == 0 {
+				velocity = midiDefaultVelocity
+			}
+			region := voice.Sampler.getRegion(n.Value-midiNoteValueOffset, velocity)
+			if region == nil {
+				fmt.Println("no sample region plays", n.ScientificPitch(), "at velocity", velocity)
+				continue
+			}
+			region.generate(freq, opts.SampleRate, data[start:], end-start, startGain, endGain)
+		case fm != nil:
+			fm.generate(freq, opts.SampleRate, data[start:end], env, startGain, endGain)
+		case v.Pluck != nil:
+			// seeded by position so the same motif always renders the same plucks
+			pluck.generate(rand.New(rand.NewSource(int64(start))), freq, opts.SampleRate, data[start:end], env, startGain, endGain)
+		default:
+			generateAudioFrequency(osc, freq, data[start:end], env, startGain, endGain)
+		}
+	}
+	return []audio.FloatBuffer{{Data: getInterleavedChannels(data, opts.Channels), Format: opts.format()}}, nil
+}
+
+// take a position of the motif and return the sample it lands on
+func getSamplePosition(meta Meta, beat int, sampleRate int) int {
+	secs := getMotifDurationInSeconds(meta, 1, beat-1)
+	return int(math.Round(secs * float64(sampleRate)))
+}
+
+// take mono samples and return them copied to every channel of interleaved frames
+func getInterleavedChannels(data []float64, channels int) []float64 {
+	if channels < 2 {
+		return data
+	}
+	frames := make([]float64, len(data)*channels)
+	for i, v := range data {
+		for ch := 0; ch < channels; ch++ {
+			frames[i*channels+ch] = v
+		}
+	}
+	return frames
+}
+
+// take motifs and return their audio layered into a single buffer
+func mixMotifAudio(ctx context.Context, motifs []Motif, voice voiceSettings, opts RenderOptions) ([]audio.FloatBuffer, error) {
+	if len(motifs) == 1 {
+		return motifAudioMap(ctx, motifs[0], voice, opts)
+	}
+	var layers [][]audio.FloatBuffer
+	mixLength := 0
+	for i, m := range motifs {
+		bufs, err := motifAudioMap(ctx, m, voice, opts)
+		if err != nil {
+			return nil, fmt.Errorf("voice %d of %d: %w", i+1, len(motifs), err)
+		}
+		layerLength := 0
+		for _, b := range bufs {
+			layerLength += len(b.Data)
+		}
+		if layerLength > mixLength {
+			mixLength = layerLength
+		}
+		layers = append(layers, bufs)
+	}
+	mix := make([]float64, mixLength)
+	for _, bufs := range layers {
+		offset := 0
+		for _, b := range bufs {
+			for i, v := range b.Data {
+				mix[offset+i] += v
+			}
+			offset += len(b.Data)
+		}
+	}
+	// scale the summed voices back down to full scale if they clip
+	peak := 0.0
+	for _, v := range mix {
+		peak = math.Max(peak, math.Abs(v))
+	}
+	if peak > 1 {
+		gain := 1 / peak
+		for i := range mix {
+			mix[i] *= gain
+		}
+	}
+	return []audio.FloatBuffer{{Data: mix, Format: opts.format()}}, nil
+}
+
+// take rendered mono layers and return the mix and, when asked for, the stem of every layer as interleaved frames.
+// Stems are as long as the mix and scaled with it, so they line up and sum to the mix.
+func mixLayers(layers []MixLayer, layerData [][]float64, withStems bool, headroomDB float64, opts RenderOptions) ([]float64, [][]float64) {
+	starts := make([]int, len(layers))
+	frames := 0
+	for i, l := range layers {
+		starts[i] = getSamplePosition(l.Motif.Meta, l.Offset+1, opts.SampleRate)
+		if end := starts[i] + len(layerData[i]); end > frames {
+			frames = end
+		}
+	}
+	mix := make([]float64, frames*opts.Channels)
+	var stems [][]float64
+	for i, l := range layers {
+		layer := mix
+		if withStems {
+			layer = make([]float64, len(mix))
+			stems = append(stems, layer)
+		}
+		level := math.Pow(10, l.GainDB/20)
+		gains := getPanGains(l.Pan, opts.Channels)
+		for j, v := range layerData[i] {
+			frame := (starts[i] + j) * opts.Channels
+			for ch, g := range gains {
+				layer[frame+ch] += v * level * g
+			}
+		}
+		if withStems {
+			for j, v := range layer {
+				mix[j] += v
+			}
+		}
+	}
+
+	// scale everything down together when the mix peaks above the headroom
+	peak := 0.0
+	for _, v := range mix {
+		peak = math.Max(peak, math.Abs(v))
+	}
+	ceiling := math.Pow(10, -headroomDB/20)
+	if peak > ceiling {
+		gain := ceiling / peak
+		for _, data := range append([][]float64{mix}, stems...) {
+			for j := range data {
+				data[j] *= gain
+			}
+		}
+	}
+	return mix, stems
+}
+
+// take a pan position and return the gain of every output channel, using the constant power pan law
+func getPanGains(pan float64, channels int) []float64 {
+	if channels < 2 {
+		return []float64{1}
+	}
+	angle := (pan + 1) * math.Pi / 4
+	return []float64{math.Cos(angle), math.Sin(angle)}
+}
+
+// take motif and return a MIDI track of meta and note events
+func motifMIDIMap(m Motif) midiTrack {
+	fmt.Println("mapping Motif to MIDI events")
+	var track midiTrack
+	if m.Name != "" {
+		track = append(track, midiEvent{Tick: 0, Data: getMIDIMetaEvent(0x03, []byte(m.Name))})
+	}
+	track = append(track, midiEvent{Tick: 0, Data: getMIDITempoEvent(m.Meta.Tempo, m.Meta.TimeSignature)})
+	if len(m.Meta.TimeSignature) == 2 {
+		track = append(track, midiEvent{Tick: 0, Data: getMIDITimeSignatureEvent(m.Meta.TimeSignature)})
+	}
+	if keySig, ok := getMIDIKeySignatureEvent(m.Meta.Key, m.Meta.Mode); ok {
+		track = append(track, midiEvent{Tick: 0, Data: keySig})
+	}
+	for _, c := range m.Meta.TimeSignatureChanges {
+		if len(c.TimeSignature) == 2 {
+			tick := convertDurationToMIDITicks(c.StartingBeat - 1)
+			track = append(track, midiEvent{Tick: tick, Data: getMIDITimeSignatureEvent(c.TimeSignature)})
+		}
+	}
+	// tempo events depend on the meter in effect at the time of the change
+	var tempoBeats []int
+	for _, c := range m.Meta.TempoChanges {
+		tempoBeats = append(tempoBeats, c.StartingBeat)
+	}
+	for _, c := range m.Meta.TimeSignatureChanges {
+		tempoBeats = append(tempoBeats, c.StartingBeat)
+	}
+	sort.Ints(tempoBeats)
+	for i, beat := range tempoBeats {
+		if beat <= 1 || (i > 0 && tempoBeats[i-1] == beat) {
+			continue
+		}
+		t, ts, _ := getMetaAtBeat(m.Meta, beat)
+		track = append(track, midiEvent{Tick: convertDurationToMIDITicks(beat - 1), Data: getMIDITempoEvent(t, ts)})
+	}
+	// notes are placed at their starting beat like the audio renderer does, so leading offsets and gaps line up
+	positions := m.NoteStartingBeats()
+	for i, n := range m.Notes {
+		// rests are the silence between note events
+		if n.isRest() {
+			continue
+		}
+		tick := convertDurationToMIDITicks(positions[i] - 1)
+		ticks := convertDurationToMIDITicks(n.Duration)
+		midiNote := n.Value - midiNoteValueOffset
+		velocity := m.NoteVelocity(i, positions[i])
+		if velocity == 0 {
+			velocity = midiDefaultVelocity
+		}
+		noteOn := []byte{byte(0x90 | midiDefaultChannel), byte(midiNote), byte(velocity)}
+		noteOff := []byte{byte(0x80 | midiDefaultChannel), byte(midiNote), 0}
+		track = append(track, midiEvent{Tick: tick, Data: noteOn})
+		track = append(track, midiEvent{Tick: tick + ticks, Data: noteOff})
+	}
+	return track
+}
+
+// converts Motivic.Note.duration (64th notes) to MIDI ticks
+func convertDurationToMIDITicks(dur int) int {
+	return dur * midiTicksPerQuarterNote / motivicUnitsPerQuarterNote
+}
+
+func getMIDIMetaEvent(metaType byte, data []byte) []byte {
+	var b bytes.Buffer
+	b.Write([]byte{0xFF, metaType})
+	writeMIDIVariableLengthQuantity(&b, len(data))
+	b.Write(data)
+	return b.Bytes()
+}
+
+// MIDI tempo is always expressed in microseconds per quarter note,
+// while Motivic tempo units count beats of the time signature's note value
+func getMIDITempoEvent(t Tempo, ts TimeSignature) []byte {
+	mpqn := getMIDIMicrosecondsPerQuarterNote(t, ts)
+	// Meta.Validate rejects tempos outside the 24-bit range, anything else is clamped to it
+	if mpqn < 1 || mpqn > midiMaxMicrosecondsPerQuarterNote {
+		fmt.Println("clamping tempo outside the MIDI range:", t.Units)
+		mpqn = int(math.Max(1, math.Min(float64(mpqn), float64(midiMaxMicrosecondsPerQuarterNote))))
+	}
+	return getMIDIMetaEvent(0x51, []byte{byte(mpqn >> 16), byte(mpqn >> 8), byte(mpqn)})
+}
+
+// take a tempo and the time signature it counts beats of and return the microseconds per quarter note of a MIDI tempo event
+func getMIDIMicrosecondsPerQuarterNote(t Tempo, ts TimeSignature) int {
+	bpm := t.Units
+	if bpm <= 0 {
+		bpm = 120
+	}
+	beatUnit := 4
+	if len(ts) == 2 && ts[1] > 0 {
+		beatUnit = ts[1]
+	}
+	return microsecondsPerMinute * beatUnit / (4 * bpm)
+}
+
+func getMIDITimeSignatureEvent(ts TimeSignature) []byte {
+	// denominator is stored as a negative power of two
+	denominatorPower := 0
+	for d := ts[1]; d > 1; d = d >> 1 {
+		denominatorPower++
+	}
+	// 24 MIDI clocks per metronome click and 8 32nd notes per quarter note
+	return getMIDIMetaEvent(0x58, []byte{byte(ts[0]), byte(denominatorPower), 24, 8})
+}
+
+func getMIDIKeySignatureEvent(key string, mode string) ([]byte, bool) {
+	keyIdx := Index(notes, strings.ToLower(key))
+	if keyIdx < 0 {
+		return nil, false
+	}
+	// chromatic and whole tone melodies have no key signature, so notate them as major
+	modeOffset := modeTonicOffsets[mode]
+	sharpsOrFlats := majorKeySignatures[(keyIdx-modeOffset+12)%12]
+	isMinor := byte(0)
+	if mode == "aeolian" {
+		isMinor = 1
+	}
+	return getMIDIMetaEvent(0x59, []byte{byte(int8(sharpsOrFlats)), isMinor}), true
+}
+
+// take an uploaded WAV file and return its samples mixed down to mono, with the root key and loop of its smpl chunk
+func decodeWAVSample(data []byte) (*wavSample, error) {
+	if len(data) < 12 || string(data[0:4]) != "RIFF" || string(data[8:12]) != "WAVE" {
+		return nil, errors.New("missing RIFF WAVE header")
+	}
+	s := &wavSample{RootKey: -1}
+	var format, channels, bitDepth int
+	var pcm []byte
+	for pos := 12; pos+8 <= len(data); {
+		id := string(data[pos : pos+4])
+		size := int(binary.LittleEndian.Uint32(data[pos+4 : pos+8]))
+		// truncated files keep whatever the last chunk holds
+		if size > len(data)-pos-8 {
+			size = len(data) - pos - 8
+		}
+		body := data[pos+8 : pos+8+size]
+		switch id {
+		case "fmt ":
+			if size < 16 {
+				return nil, errors.New("fmt chunk is too short")
+			}
+			format = int(binary.LittleEndian.Uint16(body[0:2]))
+			channels = int(binary.LittleEndian.Uint16(body[2:4]))
+			s.SampleRate = int(binary.LittleEndian.Uint32(body[4:8]))
+			bitDepth = int(binary.LittleEndian.Uint16(body[14:16]))
+			// WAVE_FORMAT_EXTENSIBLE files keep the actual format at the start of the sub format GUID
+			if format == 0xFFFE && size >= 26 {
+				format = int(binary.LittleEndian.Uint16(body[24:26]))
+			}
+		case "data":
+			pcm = body
+		case "smpl":
+			if size < 36 {
+				break
+			}
+			if key := int(binary.LittleEndian.Uint32(body[12:16])); key <= midiMaxKey {
+				s.RootKey = key
+			}
+			// the first sample loop, whose end is the last frame of the loop
+			if binary.LittleEndian.Uint32(body[28:32]) > 0 && size >= 60 {
+				s.LoopStart = int(binary.LittleEndian.Uint32(body[44:48]))
+				s.LoopEnd = int(binary.LittleEndian.Uint32(body[48:52])) + 1
+			}
+		}
+		pos += 8 + size + size%2
+	}
+	if channels < 1 || s.SampleRate <= 0 || pcm == nil {
+		return nil, errors.New("missing fmt or data chunk")
+	}
+	decode, err := getWAVSampleDecoder(format, bitDepth)
+	if err != nil {
+		return nil, err
+	}
+	bytesPerSample := bitDepth / 8
+	frameSize := bytesPerSample * channels
+	s.Data = make([]float64, len(pcm)/frameSize)
+	if len(s.Data) < 2 {
+		return nil, errors.New("data chunk holds no audio")
+	}
+	for i := range s.Data {
+		sum := 0.0
+		for ch := 0; ch < channels; ch++ {
+			offset := i*frameSize + ch*bytesPerSample
+			sum += decode(pcm[offset : offset+bytesPerSample])
+		}
+		s.Data[i] = sum / float64(channels)
+	}
+	// loops outside the audio are ignored
+	if s.LoopEnd > len(s.Data) || s.LoopEnd <= s.LoopStart {
+		s.LoopStart, s.LoopEnd = 0, 0
+	}
+	return s, nil
+}
+
+// take the format and bit depth of a WAV file and return a function converting one of its samples to a value from -1 to 1
+func getWAVSampleDecoder(format int, bitDepth int) (func([]byte) float64, error) {
+	switch {
+	case format == 1 && bitDepth == 8:
+		return func(b []byte) float64 { return (float64(b[0]) - 128) / 128 }, nil
+	case format == 1 && bitDepth == 16:
+		return func(b []byte) float64 { return float64(int16(binary.LittleEndian.Uint16(b))) / (1 << 15) }, nil
+	case format == 1 && bitDepth == 24:
+		return func(b []byte) float64 {
+			return float64(int32(uint32(b[0])<<8|uint32(b[1])<<16|uint32(b[2])<<24)>>8) / (1 << 23)
+		}, nil
+	case format == 1 && bitDepth == 32:
+		return func(b []byte) float64 { return float64(int32(binary.LittleEndian.Uint32(b))) / (1 << 31) }, nil
+	case format == wavFormatIEEEFloat && bitDepth == 32:
+		return func(b []byte) float64 { return float64(math.Float32frombits(binary.LittleEndian.Uint32(b))) }, nil
+	case format == wavFormatIEEEFloat && bitDepth == 64:
+		return func(b []byte) float64 { return math.Float64frombits(binary.LittleEndian.Uint64(b)) }, nil
+	}
+	return nil, fmt.Errorf("%d-bit samples of format %d are not supported", bitDepth, format)
+}
+
+// take a Standard MIDI File and return its tracks of absolute tick events
+func decodeMIDIFile(r io.Reader) (decodedMIDIFile, error) {
+	var f decodedMIDIFile
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return f, err
+	}
+	if len(data) < 14 || string(data[0:4]) != "MThd" {
+		return f, errors.New("not a Standard MIDI File")
+	}
+	headerLen := int(binary.BigEndian.Uint32(data[4:8]))
+	if headerLen < 6 {
+		return f, fmt.Errorf("MIDI header is %d bytes, expected at least 6", headerLen)
+	}
+	f.Format = int(binary.BigEndian.Uint16(data[8:10]))
+	numTracks := int(binary.BigEndian.Uint16(data[10:12]))
+	division := binary.BigEndian.Uint16(data[12:14])
+	if division&0x8000 != 0 {
+		return f, errors.New("SMPTE time division is not supported")
+	}
+	if division == 0 {
+		return f, errors.New("time division of 0 ticks per quarter note")
+	}
+	f.Division = int(division)
+	pos := 8 + headerLen
+	for pos+8 <= len(data) && len(f.Tracks) < numTracks {
+		chunkType := string(data[pos : pos+4])
+		chunkLen := int(binary.BigEndian.Uint32(data[pos+4 : pos+8]))
+		pos += 8
+		if pos+chunkLen > len(data) {
+			return f, errors.New("MIDI file is truncated")
+		}
+		// unknown chunk types must be ignored
+		if chunkType == "MTrk" {
+			track, err := decodeMIDITrack(data[pos : pos+chunkLen])
+			if err != nil {
+				return f, fmt.Errorf("track %d: %v", len(f.Tracks), err)
+			}
+			f.Tracks = append(f.Tracks, track)
+		}
+		pos += chunkLen
+	}
+	return f, nil
+}
+
+// take the data of an MTrk chunk and return its channel and meta events
+func decodeMIDITrack(data []byte) (midiTrack, error) {
+	var track midiTrack
+	truncated := errors.New("track is truncated")
+	pos := 0
+	tick := 0
+	var runningStatus byte
+	for pos < len(data) {
+		delta, n, err := readMIDIVariableLengthQuantity(data[pos:])
+		if err != nil {
+			return track, err
+		}
+		pos += n
+		tick += delta
+		if pos >= len(data) {
+			return track, truncated
+		}
+		status := data[pos]
+		switch {
+		case status == 0xFF:
+			if pos+2 > len(data) {
+				return track, truncated
+			}
+			length, n, err := readMIDIVariableLengthQuantity(data[pos+2:])
+			if err != nil {
+				return track, err
+			}
+			end := pos + 2 + n + length
+			if end > len(data) {
+				return track, truncated
+			}
+			track = append(track, midiEvent{Tick: tick, Data: data[pos:end]})
+			if data[pos+1] == 0x2F {
+				// end of track
+				return track, nil
+			}
+			pos = end
+		case status == 0xF0 || status == 0xF7:
+			// system exclusive messages don't carry any music
+			length, n, err := readMIDIVariableLengthQuantity(data[pos+1:])
+			if err != nil {
+				return track, err
+			}
+			pos += 1 + n + length
+			if pos > len(data) {
+				return track, truncated
+			}
+			runningStatus = 0
+		default:
+			if status < 0x80 {
+				if runningStatus == 0 {
+					return track, errors.New("data byte without a status byte")
+				}
+				status = runningStatus
+			} else {
+				runningStatus = status
+				pos++
+			}
+			if status >= 0xF0 {
+				return track, fmt.Errorf("unexpected status byte %X", status)
+			}
+			size := 2
+			if status&0xF0 == 0xC0 || status&0xF0 == 0xD0 {
+				size = 1
+			}
+			if pos+size > len(data) {
+				return track, truncated
+			}
+			for _, b := range data[pos : pos+size] {
+				if b >= 0x80 {
+					return track, fmt.Errorf("data byte %X of status %X at tick %d is not below 80", b, status, tick)
+				}
+			}
+			e := append([]byte{status}, data[pos:pos+size]...)
+			track = append(track, midiEvent{Tick: tick, Data: e})
+			pos += size
+		}
+	}
+	return track, nil
+}
+
+func isMIDIMetaEvent(e midiEvent, metaType byte) bool {
+	return len(e.Data) > 2 && e.Data[0] == 0xFF && e.Data[1] == metaType
+}
+
+func getMIDIMetaEventData(e midiEvent) []byte {
+	_, n, _ := readMIDIVariableLengthQuantity(e.Data[2:])
+	return e.Data[2+n:]
+}
+
+func readMIDIVariableLengthQuantity(data []byte) (int, int, error) {
+	v := 0
+	for i := 0; i < len(data) && i < 4; i++ {
+		v = v<<7 | int(data[i]&0x7F)
+		if data[i]&0x80 == 0 {
+			return v, i + 1, nil
+		}
+	}
+	return 0, 0, errors.New("invalid variable length quantity")
+}
+
+func writeMIDIVariableLengthQuantity(b *bytes.Buffer, v int) {
+	// 7 bits per byte, most significant group first, continuation bit on all but the last byte
+	buf := []byte{byte(v & 0x7F)}
+	for v >>= 7; v > 0; v >>= 7 {
+		buf = append([]byte{byte(v&0x7F) | 0x80}, buf...)
+	}
+	b.Write(buf)
+}
+
+// take motifs and return their Motivic JSON representation
+func motifJSONMap(motifs []Motif) ([]byte, error) {
+	fmt.Println("mapping Motifs to JSON")
+	mapped := []Motif{}
+	for _, m := range motifs {
+		mapped = append(mapped, m.Normalized())
+	}
+	// match the indentation of the web app's JSON downloads
+	return json.MarshalIndent(mapped, "", "    ")
+}
+
+// return the value of the motif's first pitched note, 0 when it only has rests
+func (m Motif) firstValue() int {
+	for _, n := range m.Notes {
+		if !n.isRest() {
+			return n.Value
+		}
+	}
+	return 0
+}
+
+// NoteSteps : semitones from the motif's first pitched note to note i, 0 for rests
+func (m Motif) NoteSteps(i int) int {
+	if m.Notes[i].isRest() {
+		return 0
+	}
+	return m.Notes[i].Value - m.firstValue()
+}
+
+// NoteStartingBeats : 1-based position of every note, notes without a position follow the previous note
+func (m Motif) NoteStartingBeats() []int {
+	beat := 1
+	var positions []int
+	for _, n := range m.Notes {
+		if n.StartingBeat > 0 {
+			beat = n.StartingBeat
+		}
+		positions = append(positions, beat)
+		beat += n.Duration
+	}
+	return positions
+}
+
+// NoteInterval : 1-based scale degree of note i within the motif's key and mode, 0 for rests and notes outside the scale.
+// Motifs without a key are in the key of their first pitched note.
+func (m Motif) NoteInterval(i int) int {
+	n := m.Notes[i]
+	if n.isRest() {
+		return 0
+	}
+	key := strings.ToLower(m.Meta.Key)
+	if key == "" {
+		key, _ = getNoteNameAndOctave(m.firstValue())
+	}
+	return Index(getKeySet(key, m.Meta.Mode), n.PitchName()) + 1
+}
+
+// NoteVelocity : MIDI velocity note i starts at beat with, its own velocity or else the motif's dynamics there,
+// 0 for rests and when neither is set. Callers pass the note's position from NoteStartingBeats.
+func (m Motif) NoteVelocity(i int, beat int) int {
+	n := m.Notes[i]
+	if n.isRest() {
+		return 0
+	}
+	if n.Velocity > 0 {
+		return n.Velocity
+	}
+	velocity, ok := getDynamicVelocityAtBeat(m.Meta, beat)
+	if !ok {
+		return 0
+	}
+	return int(math.Round(velocity))
+}
+
+// take the position and length of note i and return its gain where it starts and ends,
+// ramping during hairpins. Notes without a velocity or dynamics play at full scale.
+func (m Motif) noteGains(i int, beat int) (float64, float64) {
+	n := m.Notes[i]
+	if n.Velocity > 0 {
+		return getVelocityGain(float64(n.Velocity)), getVelocityGain(float64(n.Velocity))
+	}
+	start, ok := getDynamicVelocityAtBeat(m.Meta, beat)
+	if !ok {
+		return 1, 1
+	}
+	end, _ := getDynamicVelocityAtBeat(m.Meta, beat+n.Duration)
+	return getVelocityGain(start), getVelocityGain(end)
+}
+
+// take a position of the motif and return the velocity its dynamics are at there, false when none are in effect yet.
+// Hairpins without a marking before them start at mf.
+func getDynamicVelocityAtBeat(meta Meta, beat int) (float64, bool) {
+	velocity := float64(dynamicVelocities["mf"])
+	ok := false
+	for i, d := range meta.Dynamics {
+		if d.StartingBeat > beat {
+			break
+		}
+		ok = true
+		if v, isMarking := dynamicVelocities[d.Marking]; isMarking {
+			velocity = float64(v)
+			continue
+		}
+		// a hairpin is cut short by the next change
+		at := beat
+		if i+1 < len(meta.Dynamics) && meta.Dynamics[i+1].StartingBeat <= beat {
+			at = meta.Dynamics[i+1].StartingBeat
+		}
+		target := getHairpinTargetVelocity(d, velocity)
+		if at >= d.EndingBeat {
+			velocity = target
+			continue
+		}
+		progress := float64(at-d.StartingBeat) / float64(d.EndingBeat-d.StartingBeat)
+		velocity += (target - velocity) * progress
+	}
+	return velocity, ok
+}
+
+// take a hairpin and the velocity it starts at and return the velocity it ends at
+func getHairpinTargetVelocity(d DynamicChange, from float64) float64 {
+	if v, ok := dynamicVelocities[d.Target]; ok {
+		return float64(v)
+	}
+	if d.Marking == crescendoMarking {
+		for _, marking := range dynamicMarkings {
+			if v := float64(dynamicVelocities[marking]); v > from {
+				return v
+			}
+		}
+		return float64(midiMaxVelocity)
+	}
+	for i := len(dynamicMarkings) - 1; i >= 0; i-- {
+		if v := float64(dynamicVelocities[dynamicMarkings[i]]); v < from {
+			return v
+		}
+	}
+	return float64(dynamicVelocities[dynamicMarkings[0]])
+}
+
+// take a MIDI velocity and return the amplitude it is rendered at, squared so velocity steps sound even
+func getVelocityGain(velocity float64) float64 {
+	return math.Pow(velocity/float64(midiMaxVelocity), 2)
+}
+
+// Normalized : copy of the motif with the derived fields of every note recomputed,
+// so clients only need to send values and durations
+func (m Motif) Normalized() Motif {
+	positions := m.NoteStartingBeats()
+	normalized := m
+	normalized.Meta.Key = strings.ToLower(m.Meta.Key)
+	normalized.Notes = []MotifNote{}
+	for i, n := range m.Notes {
+		note := newNote(n.Value, n.Duration)
+		if !note.isRest() {
+			note.Velocity = n.Velocity
+		}
+		normalized.Notes = append(normalized.Notes, MotifNote{
+			Note:         note,
+			Steps:        m.NoteSteps(i),
+			StartingBeat: positions[i],
+			Interval:     m.NoteInterval(i),
+		})
+	}
+	return normalized
+}
+
+// take key and mode and return the note names of the scale
+func getKeySet(key string, mode string) []string {
+	keyIdx := Index(notes, key)
+	if keyIdx < 0 {
+		keyIdx = 0
+	}
+	degrees, ok := modes[mode]
+	if !ok {
+		degrees = modes["chromatic"]
+	}
+	var keySet []string
+	for _, d := range degrees {
+		keySet = append(keySet, notes[(keyIdx+d)%12])
+	}
+	return keySet
+}
+
+// take oscillator and frequency and add one note to its slice of the motif's audio buffer,
+// its gain moving from startGain to endGain over the note
+func generateAudioFrequency(osc *oscillator, freq float64, data []float64, env Envelope, startGain float64, endGain float64) {
+	note := make([]float64, len(data))
+	osc.fill(note, freq)
+	env.apply(note, osc.sampleRate)
+	addNoteSamples(data, note, startGain, endGain)
+}
+
+// add a rendered note to its slice of the motif's audio buffer, its gain moving from startGain to endGain.
+// Samples stay between -1 and 1 until the encoder scales them to the output bit depth.
+func addNoteSamples(data []float64, note []float64, startGain float64, endGain float64) {
+	for i, v := range note {
+		gain := startGain + (endGain-startGain)*float64(i)/float64(len(note))
+		data[i] += v * gain
+	}
+}
+
+// take a frequency and add one plucked note to its slice of the motif's audio buffer.
+// A burst of noise circulates in a delay line one period long, losing energy and high frequencies every cycle.
+func (p PluckedString) generate(rng *rand.Rand, freq float64, sampleRate int, data []float64, env Envelope, startGain float64, endGain float64) {
+	// the averaging filter delays the loop by half a sample and an allpass filter tunes the fractional rest
+	period := float64(sampleRate) / freq
+	delay := int(period - 0.5)
+	if delay < 2 {
+		delay = 2
+	}
+	// notes too high for the shortest loop play slightly flat rather than make the allpass filter unstable
+	frac := math.Max(0, math.Min(period-0.5-float64(delay), 1-1e-9))
+	allpass := (1 - frac) / (1 + frac)
+	decaySecs := pluckMinDecaySecs + (pluckMaxDecaySecs-pluckMinDecaySecs)*math.Pow(1-p.Damping, 2)
+	// -60dB after decaySecs, whatever the pitch
+	loopGain := math.Pow(10, -3*period/float64(sampleRate)/decaySecs)
+
+	// darker plucks smooth the noise burst, which is centred and scaled to full scale
+	line := make([]float64, delay)
+	smoothing := 1 - p.Brightness*0.95
+	prev, mean := 0.0, 0.0
+	for i := range line {
+		prev += (rng.Float64()*2 - 1 - prev) * (1 - smoothing)
+		line[i] = prev
+		mean += prev / float64(delay)
+	}
+	peak := 0.0
+	for i := range line {
+		line[i] -= mean
+		peak = math.Max(peak, math.Abs(line[i]))
+	}
+	if peak > 0 {
+		for i := range line {
+			line[i] /= peak
+		}
+	}
+
+	note := make([]float64, len(data))
+	pos, last, apIn, apOut := 0, line[delay-1], 0.0, 0.0
+	for i := range note {
+		cur := line[pos]
+		note[i] = cur
+		filtered := loopGain * (cur + last) / 2
+		last = cur
+		apOut = allpass*filtered + apIn - allpass*apOut
+		apIn = filtered
+		line[pos] = apOut
+		pos = (pos + 1) % delay
+	}
+	env.apply(note, sampleRate)
+	addNoteSamples(data, note, startGain, endGain)
+}
+
+func (p PluckedString) validate() error {
+	if p.Damping < 0 || p.Damping > 1 {
+		return &APIError{Status: http.StatusBadRequest, Code: errCodeInvalidVoice, Field: "pluck.damping", Message: "pluck damping must be between 0 and 1"}
+	}
+	if p.Brightness < 0 || p.Brightness > 1 {
+		return &APIError{Status: http.StatusBadRequest, Code: errCodeInvalidVoice, Field: "pluck.brightness", Message: "pluck brightness must be between 0 and 1"}
+	}
+	return nil
+}
+
+// take a frequency and add one FM note to its slice of the motif's audio buffer.
+// Every operator starts its cycle with the note, and carriers are scaled down together when their levels add up to more than full scale.
+func (f FMVoice) generate(freq float64, sampleRate int, data []float64, env Envelope, startGain float64, endGain float64) {
+	ops := f.Operators
+	levels := make([][]float64, len(ops))
+	carrierLevel := 0.0
+	for i, op := range ops {
+		levels[i] = make([]float64, len(data))
+		for j := range levels[i] {
+			levels[i][j] = 1
+		}
+		op.Envelope.apply(levels[i], sampleRate)
+		if op.Modulates == nil {
+			carrierLevel += op.Index
+		}
+	}
+	scale := 1.0
+	if carrierLevel > 1 {
+		scale = 1 / carrierLevel
+	}
+
+	phases := make([]float64, len(ops))
+	prev := make([]float64, len(ops)) // last sine value of each operator, for feedback
+	mods := make([]float64, len(ops))
+	note := make([]float64, len(data))
+	for j := range note {
+		for i := range mods {
+			mods[i] = 0
+		}
+		// modulators come after the operators they modulate, so their output is ready first
+		for i := len(ops) - 1; i >= 0; i-- {
+			op := ops[i]
+			prev[i] = math.Sin(2*math.Pi*phases[i] + mods[i] + op.Feedback*prev[i])
+			out := prev[i] * op.Index * levels[i][j]
+			if op.Modulates != nil {
+				mods[*op.Modulates] += out
+			} else {
+				note[j] += out * scale
+			}
+			phases[i] += freq * op.Ratio / float64(sampleRate)
+			phases[i] -= math.Floor(phases[i])
+		}
+	}
+	env.apply(note, sampleRate)
+	addNoteSamples(data, note, startGain, endGain)
+}
+
+// Validate : check the operators and how they are connected, returning every problem found
+func (f FMVoice) Validate() ValidationErrors {
+	var errs ValidationErrors
+	if len(f.Operators) < minFMOperators || len(f.Operators) > maxFMOperators {
+		errs = append(errs, ValidationError{"operators", -1, fmt.Sprintf("must have %d to %d operators", minFMOperators, maxFMOperators)})
+	}
+	for i, op := range f.Operators {
+		field := fmt.Sprintf("operators[%d].", i)
+		if op.Ratio <= 0 {
+			errs = append(errs, ValidationError{field + "ratio", -1, "must be greater than 0"})
+		}
+		switch {
+		case op.Modulates == nil && (op.Index < 0 || op.Index > 1):
+			errs = append(errs, ValidationError{field + "index", -1, "must be between 0 and 1 for a carrier"})
+		case op.Modulates != nil && (op.Index < 0 || op.Index > maxFMIndex):
+			errs = append(errs, ValidationError{field + "index", -1, fmt.Sprintf("must be between 0 and %v for a modulator", maxFMIndex)})
+		}
+		if op.Modulates != nil && (*op.Modulates < 0 || *op.Modulates >= i) {
+			errs = append(errs, ValidationError{field + "modulates", -1, "must be the index of an earlier operator"})
+		}
+		if op.Feedback < 0 || op.Feedback > 1 {
+			errs = append(errs, ValidationError{field + "feedback", -1, "must be between 0 and 1"})
+		}
+		if err := op.Envelope.validate(); err != nil {
+			errs = append(errs, ValidationError{field + "envelope", -1, err.(*APIError).Message})
+		}
+	}
+	return errs
+}
+
+// take the index of an FM operator and return a reference to it for FMOperator.Modulates
+func fmOperator(i int) *int {
+	return &i
+}
+
+// take a MIDI key and velocity and return the region playing it, the one recorded closest to the key when several do
+func (s *Sampler) getRegion(key int, velocity int) *SamplerRegion {
+	var region *SamplerRegion
+	for _, r := range s.Regions {
+		if key < r.LoKey || key > r.HiKey || velocity < r.LoVel || velocity > r.HiVel {
+			continue
+		}
+		if region == nil || math.Abs(float64(key-r.KeyCenter)) < math.Abs(float64(key-region.KeyCenter)) {
+			region = r
+		}
+	}
+	return region
+}
+
+// return the longest release of the sampler's regions in output samples
+func (s *Sampler) getMaxReleaseSamples(sampleRate int) int {
+	release := minSamplerReleaseSecs
+	for _, r := range s.Regions {
+		release = math.Max(release, r.Release)
+	}
+	return int(release * float64(sampleRate))
+}
+
+// take a frequency and add one sampled note to the motif's audio buffer from the note's start, held for noteLength samples.
+// data runs on past the note so the release tail can ring over whatever follows.
+func (r *SamplerRegion) generate(freq float64, sampleRate int, data []float64, noteLength int, startGain float64, endGain float64) {
+	src := r.sample.Data
+	step := freq / getMIDIKeyFrequency(r.KeyCenter) * math.Pow(2, r.Tune/1200) * float64(r.sample.SampleRate) / float64(sampleRate)
+	level := math.Pow(10, r.Volume/20)
+	release := int(math.Max(r.Release, minSamplerReleaseSecs) * float64(sampleRate))
+	length := noteLength + release
+	if r.LoopMode == oneShotLoopMode {
+		// one shots play the whole sample whatever the length of the note
+		length = len(data)
+	}
+	loopLength := float64(r.LoopEnd - r.LoopStart)
+	crossfade := math.Min(math.Min(r.LoopCrossfade*float64(r.sample.SampleRate), float64(r.LoopStart)), loopLength)
+	pos := 0.0
+	for i := 0; i < len(data) && i < length; i++ {
+		// loop_sustain stops looping once the note is released
+		looping := r.LoopMode == loopContinuousMode || (r.LoopMode == loopSustainMode && i < noteLength)
+		if looping && pos >= float64(r.LoopEnd) {
+			pos -= loopLength
+		}
+		if pos >= float64(len(src)-1) {
+			break
+		}
+		v := getInterpolatedSample(src, pos)
+		// the end of the loop fades into the frames leading up to its start, so the jump back is seamless
+		if looping && crossfade > 0 && pos >= float64(r.LoopEnd)-crossfade {
+			t := (pos - (float64(r.LoopEnd) - crossfade)) / crossfade
+			v = v*(1-t) + getInterpolatedSample(src, pos-loopLength)*t
+		}
+		gain := endGain
+		switch {
+		case i < noteLength:
+			gain = startGain + (endGain-startGain)*float64(i)/float64(noteLength)
+		case r.LoopMode != oneShotLoopMode:
+			gain *= 1 - float64(i-noteLength)/float64(release)
+		}
+		data[i] += v * level * gain
+		pos += step
+	}
+}
+
+// take samples and a fractional position and return the value there, linearly interpolated
+func getInterpolatedSample(src []float64, pos float64) float64 {
+	i := int(pos)
+	if i < 0 {
+		return 0
+	}
+	if i+1 >= len(src) {
+		return src[len(src)-1]
+	}
+	frac := pos - float64(i)
+	return src[i]*(1-frac) + src[i+1]*frac
+}
+
+// take a MIDI key and return its equal tempered frequency
+func getMIDIKeyFrequency(key int) float64 {
+	return 440 * math.Pow(2, float64(key-69)/12)
+}
+
+// oscillator : phase continuous oscillator producing values from -1 to 1
+type oscillator struct {
+	shape      generator.WaveType
+	phase      float64 // position within the current cycle (0-1)
+	sampleRate int
+}
+
+func (o *oscillator) fill(data []float64, freq float64) {
+	incr := freq / float64(o.sampleRate)
+	for i := range data {
+		data[i] = getWaveSample(o.shape, o.phase)
+		o.phase += incr
+		o.phase -= math.Floor(o.phase)
+	}
+}
+
+// every wave shape starts its cycle at zero, rising
+func getWaveSample(shape generator.WaveType, phase float64) float64 {
+	switch shape {
+	case generator.WaveTriangle:
+		return 1 - 4*math.Abs(math.Mod(phase+0.25, 1)-0.5)
+	case generator.WaveSqr:
+		if phase < 0.5 {
+			return 1
+		}
+		return -1
+	case generator.WaveSaw:
+		return 2*math.Mod(phase+0.5, 1) - 1
+	default:
+		return math.Sin(2 * math.Pi * phase)
+	}
+}
+
+// shape the amplitude of one note's samples, releasing before the note ends so notes never overlap
+func (e Envelope) apply(data []float64, sampleRate int) {
+	msToSamples := func(ms float64) float64 { return ms * float64(sampleRate) / 1000 }
+	attack := msToSamples(e.Attack)
+	decay := msToSamples(e.Decay)
+	release := msToSamples(e.Release)
+	// short notes squeeze the envelope stages proportionally
+	if total := attack + decay + release; total > float64(len(data)) {
+		scale := float64(len(data)) / total
+		attack *= scale
+		decay *= scale
+		release *= scale
+	}
+	releaseStart := float64(len(data)) - release
+	levelAt := func(i float64) float64 {
+		switch {
+		case i < attack:
+			return i / attack
+		case i < attack+decay:
+			return 1 - (1-e.Sustain)*(i-attack)/decay
+		default:
+			return e.Sustain
+		}
+	}
+	releaseLevel := levelAt(releaseStart)
+	for i := range data {
+		pos := float64(i)
+		level := levelAt(pos)
+		if pos >= releaseStart && release > 0 {
+			level = releaseLevel * (1 - (pos-releaseStart)/release)
+		}
+		data[i] *= level
+	}
+}
+
+// take the voice's default envelope and return it with the fields the override sets
+func (o *EnvelopeOverride) over(e Envelope) Envelope {
+	if o == nil {
+		return e
+	}
+	if o.Attack != nil {
+		e.Attack = *o.Attack
+	}
+	if o.Decay != nil {
+		e.Decay = *o.Decay
+	}
+	if o.Sustain != nil {
+		e.Sustain = *o.Sustain
+	}
+	if o.Release != nil {
+		e.Release = *o.Release
+	}
+	return e
+}
+
+// the fields left out are taken from a default envelope, which is always valid
+func (o *EnvelopeOverride) validate() error {
+	return o.over(Envelope{}).validate()
+}
+
+func (e Envelope) validate() error {
+	if e.Attack < 0 || e.Decay < 0 || e.Release < 0 {
+		return &APIError{Status: http.StatusBadRequest, Code: errCodeInvalidEnvelope, Field: "envelope", Message: "envelope attack, decay and release must not be negative"}
+	}
+	if e.Sustain < 0 || e.Sustain > 1 {
+		return &APIError{Status: http.StatusBadRequest, Code: errCodeInvalidEnvelope, Field: "envelope.sustain", Message: "envelope sustain must be between 0 and 1"}
+	}
+	return nil
+}
+
+// fill in the 16/44/mono defaults for any option the request left out
+func (o RenderOptions) withDefaults() RenderOptions {
+	if o.SampleRate == 0 {
+		o.SampleRate = defaultAudioSampleRate
+	}
+	if o.SampleFormat == "" {
+		o.SampleFormat = intSampleFormat
+	}
+	if o.BitDepth == 0 {
+		o.BitDepth = defaultAudioBitDepth
+		if o.SampleFormat == floatSampleFormat {
+			o.BitDepth = 32
+		}
+	}
+	if o.Channels == 0 {
+		o.Channels = defaultAudioChannels
+	}
+	return o
+}
+
+// the Field of the returned error names the offending RenderOptions JSON field
+func (o RenderOptions) validate(format string) error {
+	if !containsInt(supportedSampleRates, o.SampleRate) {
+		return newRenderOptionsError("sampleRate", fmt.Sprintf("sample rate must be one of %v", supportedSampleRates))
+	}
+	bitDepths, ok := supportedBitDepths[o.SampleFormat]
+	if !ok {
+		return newRenderOptionsError("sampleFormat", fmt.Sprintf("sample format must be %q or %q", intSampleFormat, floatSampleFormat))
+	}
+	if !containsInt(bitDepths, o.BitDepth) {
+		return newRenderOptionsError("bitDepth", fmt.Sprintf("bit depth of %v samples must be one of %v", o.SampleFormat, bitDepths))
+	}
+	if o.Channels < 1 || o.Channels > 2 {
+		return newRenderOptionsError("channels", "channels must be 1 (mono) or 2 (stereo)")
+	}
+	if o.SampleFormat == floatSampleFormat && format != wavFile {
+		return newRenderOptionsError("sampleFormat", "float samples are only supported in WAV files")
+	}
+	if format == flacFile && o.BitDepth > 24 {
+		return newRenderOptionsError("bitDepth", "FLAC files support 16 or 24-bit samples")
+	}
+	return nil
+}
+
+func newRenderOptionsError(field string, message string) *APIError {
+	return &APIError{Status: http.StatusBadRequest, Code: errCodeInvalidRenderOptions, Field: field, Message: message}
+}
+
+func (o RenderOptions) format() *audio.Format {
+	return &audio.Format{NumChannels: o.Channels, SampleRate: o.SampleRate}
+}
+
+// take the sample files and sample map of an upload form and return its sampler, nil when no samples were uploaded
+func getFormSampler(r *http.Request) (*Sampler, *APIError) {
+	if r.MultipartForm == nil || len(r.MultipartForm.File["mySampleFiles"]) == 0 {
+		return nil, nil
+	}
+	headers := r.MultipartForm.File["mySampleFiles"]
+	if len(headers) > maxSampleFiles {
+		return nil, &APIError{Status: http.StatusBadRequest, Code: errCodeInvalidUpload, Field: "mySampleFiles", Message: fmt.Sprintf("at most %d sample files can be uploaded", maxSampleFiles)}
+	}
+	samples := map[string]*wavSample{}
+	var names []string
+	for i, h := range headers {
+		field := fmt.Sprintf("mySampleFiles[%d]", i)
+		f, err := h.Open()
+		if err != nil {
+			return nil, &APIError{Status: http.StatusUnprocessableEntity, Code: errCodeInvalidUpload, Field: field, Message: fmt.Sprintf("Error reading sample %v: %v", h.Filename, err), err: err}
+		}
+		data, err := ioutil.ReadAll(f)
+		f.Close()
+		if err != nil {
+			return nil, &APIError{Status: http.StatusUnprocessableEntity, Code: errCodeInvalidUpload, Field: field, Message: fmt.Sprintf("Error reading sample %v: %v", h.Filename, err), err: err}
+		}
+		sample, err := decodeWAVSample(data)
+		if err != nil {
+			return nil, &APIError{Status: http.StatusUnprocessableEntity, Code: errCodeInvalidUpload, Field: field, Message: fmt.Sprintf("%v is not a supported WAV file: %v", h.Filename, err), err: err}
+		}
+		fmt.Printf("Sample File: \t%v %d frames at %dHz, root key %d\n", h.Filename, len(sample.Data), sample.SampleRate, sample.RootKey)
+		samples[h.Filename] = sample
+		names = append(names, h.Filename)
+	}
+
+	// the sample map may be a form field or an uploaded .sfz file
+	sampleMap := r.Form.Get("mySampleMap")
+	if files := r.MultipartForm.File["mySampleMap"]; len(files) > 0 {
+		f, err := files[0].Open()
+		if err == nil {
+			var data []byte
+			data, err = ioutil.ReadAll(f)
+			f.Close()
+			sampleMap = string(data)
+		}
+		if err != nil {
+			return nil, &APIError{Status: http.StatusUnprocessableEntity, Code: errCodeInvalidUpload, Field: "mySampleMap", Message: fmt.Sprintf("Error reading the sample map %v", err), err: err}
+		}
+	}
+	sampler := &Sampler{}
+	if sampleMap != "" {
+		regions, errs := parseSampleMap(sampleMap)
+		if len(errs) > 0 {
+			return nil, newValidationAPIError(errs.withPrefix("mySampleMap."), errCodeInvalidVoice, "invalid sample map")
+		}
+		sampler.Regions = regions
+	} else {
+		// without a map every sample plays the whole keyboard, the one recorded closest to each note wins
+		for _, name := range names {
+			region := newSamplerRegion()
+			region.Sample = name
+			sampler.Regions = append(sampler.Regions, region)
+		}
+	}
+	if errs := sampler.link(samples); len(errs) > 0 {
+		return nil, newValidationAPIError(errs.withPrefix("mySampleMap."), errCodeInvalidVoice, "invalid sampler")
+	}
+	return sampler, nil
+}
+
+// SamplerRegion factory function, playing every key and velocity
+func newSamplerRegion() *SamplerRegion {
+	return &SamplerRegion{
+		KeyCenter:     -1,
+		HiKey:         midiMaxKey,
+		HiVel:         midiMaxVelocity,
+		LoopStart:     -1,
+		LoopEnd:       -1,
+		LoopCrossfade: defaultLoopCrossfadeSecs,
+		Release:       defaultSamplerReleaseSecs,
+	}
+}
+
+// take an SFZ-style sample map and return its regions, returning every problem found.
+// Opcodes of <global> and <group> headers apply to the regions after them, e.g.
+//
+//	<group> loop_mode=loop_continuous ampeg_release=0.4
+//	<region> sample=piano_c4.wav pitch_keycenter=c4 lokey=0 hikey=62
+//	<region> sample=piano_e4.wav pitch_keycenter=e4 lokey=63 hikey=127
+func parseSampleMap(text string) ([]*SamplerRegion, ValidationErrors) {
+	var errs ValidationErrors
+	var regions []*SamplerRegion
+	global, group := map[string]string{}, map[string]string{}
+	var opcodes map[string]string // of the header being read, nil for unsupported headers
+	var order []string            // opcodes in the order they were written, so key is overridden by lokey and hikey after it
+	addRegion := func() {
+		region := newSamplerRegion()
+		field := fmt.Sprintf("regions[%d].", len(regions))
+		for _, level := range []map[string]string{global, group, opcodes} {
+			for _, opcode := range order {
+				if value, ok := level[opcode]; ok {
+					if err := region.setOpcode(opcode, value); err != nil {
+						errs = append(errs, ValidationError{field + opcode, -1, err.Error()})
+					}
+				}
+			}
+		}
+		regions = append(regions, region)
+	}
+	header := ""
+	for n, line := range strings.Split(text, "\n") {
+		if i := strings.Index(line, "//"); i >= 0 {
+			line = line[:i]
+		}
+		for _, token := range strings.Fields(line) {
+			if strings.HasPrefix(token, "<") && strings.HasSuffix(token, ">") {
+				if header == "<region>" {
+					addRegion()
+				}
+				header = token
+				switch header {
+				case "<global>":
+					global = map[string]string{}
+					opcodes = global
+				case "<group>":
+					group = map[string]string{}
+					opcodes = group
+				case "<region>":
+					opcodes = map[string]string{}
+				default:
+					fmt.Println("ignoring unsupported sample map header", header)
+					opcodes = nil
+				}
+				continue
+			}
+			eq := strings.Index(token, "=")
+			if eq <= 0 {
+				errs = append(errs, ValidationError{fmt.Sprintf("line %d", n+1), -1, fmt.Sprintf("%q is not a <header> or opcode=value", token)})
+				continue
+			}
+			if opcodes == nil {
+				continue
+			}
+			opcode := token[:eq]
+			opcodes[opcode] = token[eq+1:]
+			if Index(order, opcode) < 0 {
+				order = append(order, opcode)
+			}
+		}
+	}
+	if header == "<region>" {
+		addRegion()
+	}
+	if len(regions) == 0 && len(errs) == 0 {
+		errs = append(errs, ValidationError{"regions", -1, "the sample map has no <region>"})
+	}
+	return regions, errs
+}
+
+// set a region setting from an SFZ opcode, ignoring opcodes the sampler doesn't support
+func (r *SamplerRegion) setOpcode(opcode string, value string) error {
+	var err error
+	switch opcode {
+	case "sample":
+		// only the file name matters, samples are uploaded without their folders
+		r.Sample = path.Base(strings.ReplaceAll(value, "\\", "/"))
+	case "key":
+		var key int
+		key, err = parseMIDIKey(value)
+		r.KeyCenter, r.LoKey, r.HiKey = key, key, key
+	case "pitch_keycenter":
+		r.KeyCenter, err = parseMIDIKey(value)
+	case "lokey":
+		r.LoKey, err = parseMIDIKey(value)
+	case "hikey":
+		r.HiKey, err = parseMIDIKey(value)
+	case "lovel":
+		r.LoVel, err = strconv.Atoi(value)
+	case "hivel":
+		r.HiVel, err = strconv.Atoi(value)
+	case "tune":
+		r.Tune, err = strconv.ParseFloat(value, 64)
+	case "volume":
+		r.Volume, err = strconv.ParseFloat(value, 64)
+	case "loop_mode", "loopmode":
+		r.LoopMode = value
+	case "loop_start", "loopstart":
+		r.LoopStart, err = strconv.Atoi(value)
+	case "loop_end", "loopend":
+		// SFZ loop ends are the last frame of the loop
+		r.LoopEnd, err = strconv.Atoi(value)
+		r.LoopEnd++
+	case "loop_crossfade":
+		r.LoopCrossfade, err = strconv.ParseFloat(value, 64)
+	case "ampeg_release":
+		r.Release, err = strconv.ParseFloat(value, 64)
+	default:
+		fmt.Println("ignoring unsupported sample map opcode", opcode)
+	}
+	if err != nil {
+		return fmt.Errorf("%q is not a valid value", value)
+	}
+	return nil
+}
+
+// take a MIDI key number or a note name, where c4 is middle C (60), and return the key
+func parseMIDIKey(value string) (int, error) {
+	key, err := strconv.Atoi(value)
+	if err != nil {
+		name := strings.ToLower(value)
+		accidental := 0
+		if len(name) > 2 && (name[1] == '#' || name[1] == 'b') {
+			accidental = map[byte]int{'#': 1, 'b': -1}[name[1]]
+			name = name[:1] + name[2:]
+		}
+		if len(name) < 2 {
+			return 0, fmt.Errorf("%q is not a MIDI key or note name", value)
+		}
+		pitchClass := Index(notes, name[:1])
+		octave, octaveErr := strconv.Atoi(name[1:])
+		if pitchClass < 0 || octaveErr != nil {
+			return 0, fmt.Errorf("%q is not a MIDI key or note name", value)
+		}
+		key = (octave+1)*12 + pitchClass + accidental
+	}
+	if key < 0 || key > midiMaxKey {
+		return 0, fmt.Errorf("%q is outside the MIDI key range (0-%d)", value, midiMaxKey)
+	}
+	return key, nil
+}
+
+// take the name of a sample file ending in a note name, e.g. piano_c#4.wav, and return its key.
+// Trailing numbers are more often take numbers than keys, so they don't count.
+func getFileNameKey(fileName string) (int, bool) {
+	name := strings.TrimSuffix(path.Base(fileName), path.Ext(fileName))
+	fields := strings.FieldsFunc(name, func(r rune) bool { return r == '_' || r == ' ' || r == '.' })
+	if len(fields) == 0 {
+		return 0, false
+	}
+	last := fields[len(fields)-1]
+	if last[0] >= '0' && last[0] <= '9' {
+		return 0, false
+	}
+	key, err := parseMIDIKey(last)
+	return key, err == nil
+}
+
+// attach the uploaded samples to the regions playing them and fill in settings from the samples' metadata,
+// returning every problem found
+func (s *Sampler) link(samples map[string]*wavSample) ValidationErrors {
+	var errs ValidationErrors
+	for i, r := range s.Regions {
+		field := fmt.Sprintf("regions[%d].", i)
+		sample, ok := samples[r.Sample]
+		if !ok {
+			var names []string
+			for name := range samples {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			errs = append(errs, ValidationError{field + "sample", -1, fmt.Sprintf("%q is not one of the uploaded samples %v", r.Sample, names)})
+			continue
+		}
+		r.sample = sample
+		if r.KeyCenter < 0 {
+			r.KeyCenter = sample.RootKey
+		}
+		if key, ok := getFileNameKey(r.Sample); r.KeyCenter < 0 && ok {
+			r.KeyCenter = key
+		}
+		if r.KeyCenter < 0 {
+			errs = append(errs, ValidationError{field + "pitch_keycenter", -1, fmt.Sprintf("is missing and %v has no root note in its smpl chunk or file name", r.Sample)})
+		}
+		if r.LoKey > r.HiKey {
+			errs = append(errs, ValidationError{field + "lokey", -1, "must not be above hikey"})
+		}
+		if r.LoVel < 0 || r.HiVel > midiMaxVelocity || r.LoVel > r.HiVel {
+			errs = append(errs, ValidationError{field + "lovel", -1, fmt.Sprintf("lovel and hivel must be in order between 0 and %d", midiMaxVelocity)})
+		}
+		if r.LoopStart < 0 && r.LoopEnd < 0 && sample.LoopEnd > 0 {
+			r.LoopStart, r.LoopEnd = sample.LoopStart, sample.LoopEnd
+		}
+		// like SFZ, samples with a loop loop unless told otherwise
+		if r.LoopMode == "" {
+			r.LoopMode = noLoopMode
+			if r.LoopEnd > 0 {
+				r.LoopMode = loopContinuousMode
+			}
+		}
+		switch r.LoopMode {
+		case noLoopMode, oneShotLoopMode:
+		case loopContinuousMode, loopSustainMode:
+			if r.LoopStart < 0 || r.LoopEnd <= r.LoopStart || r.LoopEnd > len(sample.Data) {
+				errs = append(errs, ValidationError{field + "loop_end", -1, fmt.Sprintf("the loop must end after it starts and within the %d frames of %v", len(sample.Data), r.Sample)})
+			}
+		default:
+			errs = append(errs, ValidationError{field + "loop_mode", -1, fmt.Sprintf("%q is not one of %v", r.LoopMode, []string{noLoopMode, oneShotLoopMode, loopContinuousMode, loopSustainMode})})
+		}
+		if r.LoopCrossfade < 0 {
+			errs = append(errs, ValidationError{field + "loop_crossfade", -1, "must not be negative"})
+		}
+		if r.Release < 0 {
+			errs = append(errs, ValidationError{field + "ampeg_release", -1, "must not be negative"})
+		}
+	}
+	return errs
+}
+
+// take the upload form fields and return render options validated for the output format
+func getFormRenderOptions(r *http.Request, format string) (RenderOptions, error) {
+	o := RenderOptions{SampleFormat: r.Form.Get("mySampleFormat")}
+	fields := []struct {
+		name  string
+		value *int
+	}{
+		{"mySampleRate", &o.SampleRate},
+		{"myBitDepth", &o.BitDepth},
+		{"myChannels", &o.Channels},
+	}
+	for _, f := range fields {
+		v := r.Form.Get(f.name)
+		if v == "" {
+			continue
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return o, &APIError{Status: http.StatusBadRequest, Code: errCodeInvalidRenderOptions, Field: f.name, Message: fmt.Sprintf("%v must be an integer", f.name)}
+		}
+		*f.value = n
+	}
+	o = o.withDefaults()
+	if err := o.validate(format); err != nil {
+		// report the form field rather than the JSON field
+		apiErr := err.(*APIError)
+		apiErr.Field = "my" + strings.ToUpper(apiErr.Field[:1]) + apiErr.Field[1:]
+		return o, apiErr
+	}
+	return o, nil
+}
+
+func containsInt(values []int, v int) bool {
+	for _, value := range values {
+		if value == v {
+			return true
+		}
+	}
+	return false
+}
+
+// take a buffer of samples from -1 to 1 and return it at the PCM scale of the bit depth
+func getIntBuffer(b audio.FloatBuffer, bitDepth int) *audio.IntBuffer {
+	factor := float64(audio.IntMaxSignedValue(bitDepth))
+	data := make([]int, len(b.Data))
+	for i, v := range b.Data {
+		data[i] = int(math.Round(math.Max(-1, math.Min(1, v)) * factor))
+	}
+	return &audio.IntBuffer{Format: b.Format, Data: data, SourceBitDepth: bitDepth}
+}
+
+func encodeWAVFile(bufs []audio.FloatBuffer, w io.WriteSeeker, opts RenderOptions) error {
+	if opts.SampleFormat == floatSampleFormat {
+		return encodeFloatWAVFile(bufs, w)
+	}
+	// APPROACH: iterate through buffers and encode each one sequentially
+	e := wav.NewEncoder(w, bufs[0].PCMFormat().SampleRate, opts.BitDepth, bufs[0].PCMFormat().NumChannels, 1)
+	for _, b := range bufs {
+		err := e.Write(getIntBuffer(b, opts.BitDepth))
+		if err != nil {
+			return err
+		}
+	}
+	return e.Close()
+}
+
+// the wav package only writes PCM, so 32-bit float files get their own RIFF writer
+// with the extended fmt chunk and the fact chunk that non-PCM WAV files require
+func encodeFloatWAVFile(bufs []audio.FloatBuffer, w io.Writer) error {
+	numChannels := bufs[0].PCMFormat().NumChannels
+	sampleRate := bufs[0].PCMFormat().SampleRate
+	samples := 0
+	for _, b := range bufs {
+		samples += len(b.Data)
+	}
+	dataSize := samples * 4
+	var out bytes.Buffer
+	out.WriteString("RIFF")
+	// WAVE id, fmt chunk, fact chunk, data chunk header and samples
+	binary.Write(&out, binary.LittleEndian, uint32(4+26+12+8+dataSize))
+	out.WriteString("WAVE")
+	out.WriteString("fmt ")
+	binary.Write(&out, binary.LittleEndian, uint32(18))
+	binary.Write(&out, binary.LittleEndian, uint16(wavFormatIEEEFloat))
+	binary.Write(&out, binary.LittleEndian, uint16(numChannels))
+	binary.Write(&out, binary.LittleEndian, uint32(sampleRate))
+	binary.Write(&out, binary.LittleEndian, uint32(sampleRate*numChannels*4))
+	binary.Write(&out, binary.LittleEndian, uint16(numChannels*4))
+	binary.Write(&out, binary.LittleEndian, uint16(32))
+	binary.Write(&out, binary.LittleEndian, uint16(0))
+	out.WriteString("fact")
+	binary.Write(&out, binary.LittleEndian, uint32(4))
+	binary.Write(&out, binary.LittleEndian, uint32(samples/numChannels))
+	out.WriteString("data")
+	binary.Write(&out, binary.LittleEndian, uint32(dataSize))
+	for _, b := range bufs {
+		for _, v := range b.Data {
+			binary.Write(&out, binary.LittleEndian, float32(math.Max(-1, math.Min(1, v))))
+		}
+	}
+	_, err := w.Write(out.Bytes())
+	return err
+}
+
+func encodeAIFFile(bufs []audio.FloatBuffer, w io.WriteSeeker, opts RenderOptions) error {
+	if opts.SampleFormat == floatSampleFormat {
+		return errors.New("float samples are only supported in WAV files")
+	}
+	e := aiff.NewEncoder(w,
+		bufs[0].PCMFormat().SampleRate,
+		opts.BitDepth,
+		bufs[0].PCMFormat().NumChannels)
+	for _, b := range bufs {
+		err := e.Write(getIntBuffer(b, opts.BitDepth))
+		if err != nil {
+			return err
+		}
+	}
+	return e.Close()
+}
+
+// lossless FLAC stream of verbatim, constant and fixed-predictor subframes
+// see https://xiph.org/flac/format.html
+func encodeFLACFile(ctx context.Context, bufs []audio.FloatBuffer, w io.Writer, opts RenderOptions) error {
+	if opts.SampleFormat == floatSampleFormat || opts.BitDepth > 24 {
+		return errors.New("FLAC files support 16 or 24-bit integer samples")
+	}
+	numChannels := bufs[0].PCMFormat().NumChannels
+	sampleRate := bufs[0].PCMFormat().SampleRate
+	var samples []int
+	for _, b := range bufs {
+		samples = append(samples, getIntBuffer(b, opts.BitDepth).Data...)
+	}
+	totalFrames := len(samples) / numChannels
+
+	// STREAMINFO carries the MD5 of the interleaved little endian samples
+	hash := md5.New()
+	sampleBytes := make([]byte, opts.BitDepth/8)
+	for _, v := range samples {
+		for i := range sampleBytes {
+			sampleBytes[i] = byte(v >> uint(8*i))
+		}
+		hash.Write(sampleBytes)
+	}
+
+	var frames bytes.Buffer
+	minFrameSize, maxFrameSize := 0, 0
+	for frameNumber, start := 0, 0; start < totalFrames; frameNumber, start = frameNumber+1, start+flacBlockSize {
+		if err := ctx.Err(); err != nil {
+			return fmt.Errorf("stopped encoding at FLAC frame %d of %d: %w", frameNumber, (totalFrames+flacBlockSize-1)/flacBlockSize, err)
+		}
+		end := start + flacBlockSize
+		if end > totalFrames {
+			end = totalFrames
+		}
+		frame := encodeFLACFrame(samples[start*numChannels:end*numChannels], numChannels, uint(opts.BitDepth), uint64(frameNumber))
+		if minFrameSize == 0 || len(frame) < minFrameSize {
+			minFrameSize = len(frame)
+		}
+		if len(frame) > maxFrameSize {
+			maxFrameSize = len(frame)
+		}
+		frames.Write(frame)
+	}
+
+	var header flacBitWriter
+	header.writeBits(uint64('f')<<24|uint64('L')<<16|uint64('a')<<8|uint64('C'), 32)
+	// last metadata block, type STREAMINFO, 34 bytes long
+	header.writeBits(1, 1)
+	header.writeBits(0, 7)
+	header.writeBits(34, 24)
+	header.writeBits(uint64(flacBlockSize), 16)
+	header.writeBits(uint64(flacBlockSize), 16)
+	header.writeBits(uint64(minFrameSize), 24)
+	header.writeBits(uint64(maxFrameSize), 24)
+	header.writeBits(uint64(sampleRate), 20)
+	header.writeBits(uint64(numChannels-1), 3)
+	header.writeBits(uint64(opts.BitDepth-1), 5)
+	header.writeBits(uint64(totalFrames), 36)
+	header.data = append(header.data, hash.Sum(nil)...)
+	if _, err := w.Write(header.data); err != nil {
+		return err
+	}
+	_, err := w.Write(frames.Bytes())
+	return err
+}
+
+// take one block of interleaved samples and return it as a FLAC frame
+func encodeFLACFrame(samples []int, numChannels int, bps uint, frameNumber uint64) []byte {
+	blockSize := len(samples) / numChannels
+	channels := make([][]int64, numChannels)
+	for ch := range channels {
+		channels[ch] = make([]int64, blockSize)
+		for i := range channels[ch] {
+			channels[ch][i] = int64(samples[i*numChannels+ch])
+		}
+	}
+	// channel assignment is the channel count minus one for independent channels
+	assignment := numChannels - 1
+	subframes := make([]flacSubframe, numChannels)
+	for ch, data := range channels {
+		subframes[ch] = getFLACSubframe(data, bps)
+	}
+	// stereo can store the difference of the channels instead of the right channel,
+	// which is all zeros when both channels carry the same signal
+	if numChannels == 2 {
+		side := make([]int64, blockSize)
+		for i := range side {
+			side[i] = channels[0][i] - channels[1][i]
+		}
+		if s := getFLACSubframe(side, bps+1); s.size < subframes[1].size {
+			subframes[1] = s
+			assignment = 8
+		}
+	}
+
+	var w flacBitWriter
+	// sync code and fixed block size strategy
+	w.writeBits(0xFFF8, 16)
+	// block size follows the frame number as 16 bits, sample rate comes from STREAMINFO
+	w.writeBits(7, 4)
+	w.writeBits(0, 4)
+	w.writeBits(uint64(assignment), 4)
+	w.writeBits(flacSampleSizeCodes[bps], 3)
+	w.writeBits(0, 1)
+	w.writeUTF8(frameNumber)
+	w.writeBits(uint64(blockSize-1), 16)
+	w.writeBits(uint64(getCRC8(w.data)), 8)
+	for _, s := range subframes {
+		s.write(&w)
+	}
+	w.align()
+	w.writeBits(uint64(getCRC16(w.data)), 16)
+	return w.data
+}
+
+// sample size codes of the frame header
+var flacSampleSizeCodes = map[uint]uint64{8: 1, 12: 2, 16: 4, 20: 5, 24: 6}
+
+// flacSubframe : the smallest encoding found for one channel of a block
+type flacSubframe struct {
+	samples        []int64
+	bps            uint
+	kind           uint64 // subframe type code: 0 constant, 1 verbatim, 8+order fixed predictor
+	order          int
+	residual       []int64
+	partitionOrder uint
+	riceParameters []uint
+	size           int // in bits
+}
+
+// take one channel of a block and return its smallest subframe
+func getFLACSubframe(samples []int64, bps uint) flacSubframe {
+	best := flacSubframe{samples: samples, bps: bps, kind: 1, size: 8 + len(samples)*int(bps)}
+	constant := true
+	for _, v := range samples {
+		if v != samples[0] {
+			constant = false
+			break
+		}
+	}
+	if constant {
+		return flacSubframe{samples: samples, bps: bps, kind: 0, size: 8 + int(bps)}
+	}
+	for order := 0; order <= flacMaxFixedOrder && order < len(samples); order++ {
+		residual := getFLACFixedResidual(samples, order)
+		partitionOrder, riceParameters, residualSize := getFLACRicePartitions(residual, len(samples), order)
+		size := 8 + order*int(bps) + 6 + residualSize
+		if size < best.size {
+			best = flacSubframe{
+				samples:        samples,
+				bps:            bps,
+				kind:           8 + uint64(order),
+				order:          order,
+				residual:       residual,
+				partitionOrder: partitionOrder,
+				riceParameters: riceParameters,
+				size:           size,
+			}
+		}
+	}
+	return best
+}
+
+// take samples and return the error of the fixed polynomial predictor of the order
+func getFLACFixedResidual(samples []int64, order int) []int64 {
+	residual := make([]int64, len(samples)-order)
+	for i := order; i < len(samples); i++ {
+		x := samples
+		switch order {
+		case 0:
+			residual[i-order] = x[i]
+		case 1:
+			residual[i-order] = x[i] - x[i-1]
+		case 2:
+			residual[i-order] = x[i] - 2*x[i-1] + x[i-2]
+		case 3:
+			residual[i-order] = x[i] - 3*x[i-1] + 3*x[i-2] - x[i-3]
+		case 4:
+			residual[i-order] = x[i] - 4*x[i-1] + 6*x[i-2] - 4*x[i-3] + x[i-4]
+		}
+	}
+	return residual
+}
+
+// take a residual and return the partition order and Rice parameters that code it in the fewest bits
+func getFLACRicePartitions(residual []int64, blockSize int, order int) (uint, []uint, int) {
+	var bestOrder uint
+	var bestParameters []uint
+	bestSize := -1
+	for p := uint(0); p <= flacMaxPartitionOrder; p++ {
+		partitionSize := blockSize >> p
+		if blockSize%(1<<p) != 0 || partitionSize <= order {
+			break
+		}
+		var parameters []uint
+		size := 0
+		start := 0
+		for i := 0; i < 1<<p; i++ {
+			// the predictor's warm-up samples come out of the first partition
+			end := start + partitionSize
+			if i == 0 {
+				end -= order
+			}
+			k, bits := getFLACRiceParameter(residual[start:end])
+			parameters = append(parameters, k)
+			size += 4 + bits
+			start = end
+		}
+		if bestSize < 0 || size < bestSize {
+			bestOrder, bestParameters, bestSize = p, parameters, size
+		}
+	}
+	return bestOrder, bestParameters, bestSize
+}
 
-	var b strings.Builder
-	for i := 0; i < length; i++ {
-		b.WriteRune(chars[rand.Intn(len(chars))])
+// take one partition of a residual and return the Rice parameter that codes it in the fewest bits
+func getFLACRiceParameter(residual []int64) (uint, int) {
+	if len(residual) == 0 {
+		return 0, 0
 	}
-	return b.String()
+	var sum uint64
+	for _, r := range residual {
+		sum += zigZag(r)
+	}
+	// the best parameter is close to log2 of the mean, so only it and its neighbours are measured
+	var estimate uint
+	for estimate < flacMaxRiceParameter && uint64(len(residual))<<(estimate+1) <= sum {
+		estimate++
+	}
+	riceBits := func(k uint) int {
+		bits := len(residual) * int(k+1)
+		for _, r := range residual {
+			bits += int(zigZag(r) >> k)
+		}
+		return bits
+	}
+	bestK, bestBits := estimate, riceBits(estimate)
+	candidates := []uint{estimate + 1}
+	if estimate > 0 {
+		candidates = append(candidates, estimate-1)
+	}
+	for _, k := range candidates {
+		if bits := riceBits(k); k <= flacMaxRiceParameter && bits < bestBits {
+			bestK, bestBits = k, bits
+		}
+	}
+	return bestK, bestBits
 }
 
-func getFilePathFromName(dir string, key string, fileName string, fileType string) (string, string) {
-	encodedName := key + "_" + fileName + "." + fileType
-	encodedFilePath := dir + encodedName
-	return encodedFilePath, encodedName
+func (s flacSubframe) write(w *flacBitWriter) {
+	// zero padding bit, subframe type and no wasted bits
+	w.writeBits(s.kind<<1, 8)
+	switch {
+	case s.kind == 0:
+		w.writeSigned(s.samples[0], s.bps)
+	case s.kind == 1:
+		for _, v := range s.samples {
+			w.writeSigned(v, s.bps)
+		}
+	default:
+		for _, v := range s.samples[:s.order] {
+			w.writeSigned(v, s.bps)
+		}
+		// Rice coding with 4 bit parameters
+		w.writeBits(0, 2)
+		w.writeBits(uint64(s.partitionOrder), 4)
+		partitionSize := len(s.samples) >> s.partitionOrder
+		start := 0
+		for i, k := range s.riceParameters {
+			end := start + partitionSize
+			if i == 0 {
+				end -= s.order
+			}
+			w.writeBits(uint64(k), 4)
+			for _, r := range s.residual[start:end] {
+				u := zigZag(r)
+				w.writeUnary(u >> k)
+				w.writeBits(u, k)
+			}
+			start = end
+		}
+	}
 }
 
-func getFileNameFromPath(path string, key string) string {
-	return strings.Split(path, key+"_")[1]
+// fold signed values onto unsigned ones: 0, -1, 1, -2, 2...
+func zigZag(v int64) uint64 {
+	return uint64(v<<1) ^ uint64(v>>63)
 }
 
-// fileExists checks if a file exists and is not a directory before we
-// try using it to prevent further errors.
-func fileExists(filename string) bool {
-	info, err := os.Stat(filename)
-	if os.IsNotExist(err) {
-		return false
+// flacBitWriter : big endian bit stream
+type flacBitWriter struct {
+	data  []byte
+	cur   byte
+	nbits uint
+}
+
+// write the low n bits of v, most significant first
+func (w *flacBitWriter) writeBits(v uint64, n uint) {
+	for i := n; i > 0; i-- {
+		w.cur = w.cur<<1 | byte(v>>(i-1)&1)
+		w.nbits++
+		if w.nbits == 8 {
+			w.data = append(w.data, w.cur)
+			w.cur, w.nbits = 0, 0
+		}
+	}
+}
+
+func (w *flacBitWriter) writeSigned(v int64, n uint) {
+	w.writeBits(uint64(v)&(1<<n-1), n)
+}
+
+// q zeros and a terminating one
+func (w *flacBitWriter) writeUnary(q uint64) {
+	for ; q > 0; q-- {
+		w.writeBits(0, 1)
 	}
-	return !info.IsDir()
+	w.writeBits(1, 1)
 }
 
-func expireFile(filePath string) {
-	if filePath == "" || !fileExists(filePath) {
+// UTF-8 style variable length number of the frame header
+func (w *flacBitWriter) writeUTF8(v uint64) {
+	if v < 0x80 {
+		w.writeBits(v, 8)
 		return
 	}
-	fileTimer := time.NewTimer(60 * time.Second)
-	<-fileTimer.C
-	fmt.Println("File deleted:", filePath)
-	os.Remove(filePath)
+	n := uint(2)
+	for v >= 1<<(5*n+1) {
+		n++
+	}
+	w.writeBits(0xFF<<(8-n)&0xFF|v>>(6*(n-1)), 8)
+	for i := n - 1; i > 0; i-- {
+		w.writeBits(0x80|v>>(6*(i-1))&0x3F, 8)
+	}
+}
+
+// pad the stream with zeros to the next byte boundary
+func (w *flacBitWriter) align() {
+	if w.nbits > 0 {
+		w.writeBits(0, 8-w.nbits)
+	}
+}
+
+// CRC-8 of the frame header, polynomial x^8 + x^2 + x + 1
+func getCRC8(data []byte) byte {
+	var crc byte
+	for _, b := range data {
+		crc ^= b
+		for i := 0; i < 8; i++ {
+			if crc&0x80 != 0 {
+				crc = crc<<1 ^ 0x07
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// CRC-16 of the whole frame, polynomial x^16 + x^15 + x^2 + 1
+func getCRC16(data []byte) uint16 {
+	var crc uint16
+	for _, b := range data {
+		crc ^= uint16(b) << 8
+		for i := 0; i < 8; i++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x8005
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// take slice of audio buffers and write audio file
+func encodeAudioFile(ctx context.Context, format string, bufs []audio.FloatBuffer, w io.WriteSeeker, opts RenderOptions) error {
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("stopped before encoding: %w", err)
+	}
+	switch format {
+	case wavFile:
+		return encodeWAVFile(bufs, w, opts)
+	case aiffFile:
+		return encodeAIFFile(bufs, w, opts)
+	case flacFile:
+		return encodeFLACFile(ctx, bufs, w, opts)
+	default:
+		return errors.New("unknown format")
+	}
+}
+
+// take slice of MIDI tracks and write a Standard MIDI File
+func encodeMIDIFile(tracks []midiTrack, w io.Writer) error {
+	// single track files are format 0, multi-track files are format 1
+	format := 0
+	if len(tracks) > 1 {
+		format = 1
+	}
+	var header bytes.Buffer
+	header.WriteString("MThd")
+	binary.Write(&header, binary.BigEndian, uint32(6))
+	binary.Write(&header, binary.BigEndian, uint16(format))
+	binary.Write(&header, binary.BigEndian, uint16(len(tracks)))
+	binary.Write(&header, binary.BigEndian, uint16(midiTicksPerQuarterNote))
+	if _, err := w.Write(header.Bytes()); err != nil {
+		return err
+	}
+	for _, t := range tracks {
+		// stable sort keeps note offs ahead of note ons that share a tick
+		events := make(midiTrack, len(t))
+		copy(events, t)
+		sort.SliceStable(events, func(i, j int) bool { return events[i].Tick < events[j].Tick })
+		var data bytes.Buffer
+		tick := 0
+		for _, e := range events {
+			writeMIDIVariableLengthQuantity(&data, e.Tick-tick)
+			data.Write(e.Data)
+			tick = e.Tick
+		}
+		// end of track
+		writeMIDIVariableLengthQuantity(&data, 0)
+		data.Write(getMIDIMetaEvent(0x2F, nil))
+
+		var chunk bytes.Buffer
+		chunk.WriteString("MTrk")
+		binary.Write(&chunk, binary.BigEndian, uint32(data.Len()))
+		chunk.Write(data.Bytes())
+		if _, err := w.Write(chunk.Bytes()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// take Motivic JSON data and write it to a .json file
+func encodeJSONFile(jsonData []byte, w io.Writer) error {
+	_, err := w.Write(jsonData)
+	return err
+}
+
+// take a length and return that many letters and digits from the system's secure random source,
+// so the keys of stored files can't be guessed
+func getRandomString(length int) string {
+	chars := []rune("ABCDEFGHIJKLMNOPQRSTUVWXYZ" +
+		"abcdefghijklmnopqrstuvwxyz" +
+		"0123456789")
+
+	var b strings.Builder
+	random := make([]byte, 1)
+	for b.Len() < length {
+		if _, err := cryptorand.Read(random); err != nil {
+			panic(fmt.Sprintf("reading the secure random source: %v", err))
+		}
+		// bytes past the last whole multiple of the character count are skipped so every character is equally likely
+		if int(random[0]) < 256/len(chars)*len(chars) {
+			b.WriteRune(chars[int(random[0])%len(chars)])
+		}
+	}
+	return b.String()
+}
+
+// take a byte count and return that many bytes of the system's secure random source in hex
+func getRandomHex(numBytes int) string {
+	random := make([]byte, numBytes)
+	if _, err := cryptorand.Read(random); err != nil {
+		panic(fmt.Sprintf("reading the secure random source: %v", err))
+	}
+	return hex.EncodeToString(random)
+}
+
+// take a file name from a request and return its base name with everything but letters, digits, '-', '_' and '.' replaced,
+// so it can't reach outside a store or make a nested S3 key
+func getSafeFileName(name string) string {
+	name = path.Base(strings.Replace(name, "\\", "/", -1))
+	var b strings.Builder
+	for _, c := range name {
+		if ('A' <= c && c <= 'Z') || ('a' <= c && c <= 'z') || ('0' <= c && c <= '9') || strings.ContainsRune("-_.", c) {
+			b.WriteRune(c)
+		} else {
+			b.WriteRune('-')
+		}
+	}
+	// path.Base turns an empty name into "."
+	return strings.Trim(b.String(), ".")
+}
+
+func getFilePathFromName(dir string, key string, fileName string, fileType string) (string, string) {
+	encodedName := key + "_" + fileName + "." + fileType
+	encodedFilePath := dir + encodedName
+	return encodedFilePath, encodedName
 }
 
 func cleanUp() {
@@ -791,76 +3868,351 @@ func cleanUpDir(dir string) error {
 	return nil
 }
 
-func saveFile(file multipart.File, handle *multipart.FileHeader, filePath string) {
-	data, err := ioutil.ReadAll(file)
-	if err != nil {
-		fmt.Println(err)
-		return
+// memoryFile : named in-memory io.WriteSeeker, so encoders that patch their headers never touch disk
+type memoryFile struct {
+	name string
+	data []byte
+	pos  int
+}
+
+// zip entries are named after the file, so the name is made safe to extract
+func newMemoryFile(name string, fileType string) *memoryFile {
+	return &memoryFile{name: getSafeFileName(name) + "." + fileType}
+}
+
+func (f *memoryFile) Write(p []byte) (int, error) {
+	if end := f.pos + len(p); end > len(f.data) {
+		f.data = append(f.data, make([]byte, end-len(f.data))...)
 	}
-	// ignore error if dir already exists
-	_ = os.Mkdir(inputFileDir, 0777)
-	err = ioutil.WriteFile(filePath, data, 0666)
-	if err != nil {
-		fmt.Println(err)
-		return
+	n := copy(f.data[f.pos:], p)
+	f.pos += n
+	return n, nil
+}
+
+func (f *memoryFile) Seek(offset int64, whence int) (int64, error) {
+	var pos int64
+	switch whence {
+	case io.SeekStart:
+		pos = offset
+	case io.SeekCurrent:
+		pos = int64(f.pos) + offset
+	case io.SeekEnd:
+		pos = int64(len(f.data)) + offset
+	default:
+		return 0, errors.New("memoryFile.Seek: invalid whence")
 	}
-	fmt.Println("Upload saved locally")
+	if pos < 0 {
+		return 0, errors.New("memoryFile.Seek: negative position")
+	}
+	f.pos = int(pos)
+	return pos, nil
+}
+
+// zipFiles compresses one or many in-memory files into a single zip archive.
+func zipFiles(files []*memoryFile) ([]byte, error) {
+	var zipData bytes.Buffer
+	zipWriter := zip.NewWriter(&zipData)
+
+	// Add files to zip
+	for _, file := range files {
+		if err := addFileToZip(zipWriter, file); err != nil {
+			return nil, err
+		}
+	}
+	if err := zipWriter.Close(); err != nil {
+		return nil, err
+	}
+	return zipData.Bytes(), nil
 }
 
-// ZipFiles compresses one or many files into a single zip archive file.
-// Param 1: filename is the output zip file's name.
-// Param 2: files is a list of files to add to the zip.
-func zipFiles(filename string, files []string, key string) error {
-	zipFile, err := os.Create(filename)
+func addFileToZip(zipWriter *zip.Writer, file *memoryFile) error {
+	header := &zip.FileHeader{
+		Name: file.name,
+		// Change to deflate to gain better compression
+		// see http://golang.org/pkg/archive/zip/#pkg-constants
+		Method:   zip.Deflate,
+		Modified: time.Now(),
+		// zip entries have no content type, so record it in the entry comment
+		Comment: getFileMIMEType(file.name),
+	}
+	writer, err := zipWriter.CreateHeader(header)
 	if err != nil {
 		return err
 	}
-	defer zipFile.Close()
+	_, err = writer.Write(file.data)
+	return err
+}
 
-	zipWriter := zip.NewWriter(zipFile)
-	defer zipWriter.Close()
+// ArtifactStore : storage for converted files awaiting download
+type ArtifactStore interface {
+	// Put stores data under name until the ttl has passed
+	Put(name string, data []byte, ttl time.Duration) error
+	// Get returns the data stored under name, or errArtifactNotFound once it has expired
+	Get(name string) ([]byte, error)
+	Delete(name string) error
+}
 
-	// Add files to zip
-	for _, file := range files {
-		if err = addFileToZip(zipWriter, file, key); err != nil {
-			return err
+var errArtifactNotFound = errors.New("artifact does not exist or has expired")
+var errInvalidArtifactName = errors.New("artifact names must not be empty or contain path separators")
+
+// stores keep artifacts side by side, so a name may never point into another directory or key prefix
+func validateArtifactName(name string) error {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, "/\\") {
+		return errInvalidArtifactName
+	}
+	return nil
+}
+
+// take the environment and return the configured artifact store
+func getArtifactStore() (ArtifactStore, error) {
+	switch store := os.Getenv(artifactStoreEnv); store {
+	case "", localArtifactStore:
+		return &LocalArtifactStore{Dir: outputFileDir}, nil
+	case s3ArtifactStore:
+		s3 := &S3ArtifactStore{
+			Endpoint:        strings.TrimSuffix(os.Getenv(s3EndpointEnv), "/"),
+			Region:          os.Getenv(s3RegionEnv),
+			Bucket:          os.Getenv(s3BucketEnv),
+			AccessKeyID:     os.Getenv(s3AccessKeyIDEnv),
+			SecretAccessKey: os.Getenv(s3SecretAccessKeyEnv),
+			Client:          &http.Client{Timeout: 30 * time.Second},
+		}
+		if s3.Region == "" {
+			s3.Region = "us-east-1"
+		}
+		if s3.Endpoint == "" {
+			s3.Endpoint = fmt.Sprintf("https://s3.%v.amazonaws.com", s3.Region)
 		}
+		if s3.Bucket == "" || s3.AccessKeyID == "" || s3.SecretAccessKey == "" {
+			return nil, fmt.Errorf("%v, %v and %v must be set for the s3 artifact store", s3BucketEnv, s3AccessKeyIDEnv, s3SecretAccessKeyEnv)
+		}
+		return s3, nil
+	default:
+		return nil, fmt.Errorf("unknown %v %q", artifactStoreEnv, store)
+	}
+}
+
+// LocalArtifactStore : artifacts stored in a directory of this instance's file system
+// the modification time of each file is set to its expiry
+type LocalArtifactStore struct {
+	Dir string
+}
+
+// Put : write the artifact to disk and delete it when it expires
+func (l *LocalArtifactStore) Put(name string, data []byte, ttl time.Duration) error {
+	if err := validateArtifactName(name); err != nil {
+		return err
 	}
+	// ignore error if dir already exists
+	_ = os.MkdirAll(l.Dir, 0777)
+	filePath := path.Join(l.Dir, name)
+	if err := ioutil.WriteFile(filePath, data, 0666); err != nil {
+		return err
+	}
+	if err := os.Chtimes(filePath, time.Now(), time.Now().Add(ttl)); err != nil {
+		return err
+	}
+	time.AfterFunc(ttl, func() {
+		fmt.Println("File deleted:", filePath)
+		l.Delete(name)
+	})
 	return nil
 }
 
-func addFileToZip(zipWriter *zip.Writer, filePath string, key string) error {
-	fileToZip, err := os.Open(filePath)
+// Get : read the artifact from disk unless it has expired
+func (l *LocalArtifactStore) Get(name string) ([]byte, error) {
+	if err := validateArtifactName(name); err != nil {
+		return nil, err
+	}
+	filePath := path.Join(l.Dir, name)
+	info, err := os.Stat(filePath)
+	if os.IsNotExist(err) || (err == nil && info.IsDir()) {
+		return nil, errArtifactNotFound
+	}
 	if err != nil {
+		return nil, err
+	}
+	if info.ModTime().Before(time.Now()) {
+		l.Delete(name)
+		return nil, errArtifactNotFound
+	}
+	return ioutil.ReadFile(filePath)
+}
+
+// Delete : remove the artifact from disk
+func (l *LocalArtifactStore) Delete(name string) error {
+	if err := validateArtifactName(name); err != nil {
 		return err
 	}
-	defer fileToZip.Close()
+	err := os.Remove(path.Join(l.Dir, name))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// S3ArtifactStore : artifacts stored in an S3-compatible bucket with path-style requests,
+// so any stand-in that speaks the S3 API (like a local MinIO) can be used as the endpoint
+// objects carry their expiry as metadata, a bucket lifecycle rule can purge them for good
+type S3ArtifactStore struct {
+	Endpoint        string
+	Region          string
+	Bucket          string
+	AccessKeyID     string
+	SecretAccessKey string
+	Client          *http.Client
+}
 
-	// Get the file information
-	info, err := fileToZip.Stat()
+// Put : upload the artifact with its expiry time
+func (s *S3ArtifactStore) Put(name string, data []byte, ttl time.Duration) error {
+	req, err := s.newRequest(http.MethodPut, name, data)
 	if err != nil {
 		return err
 	}
-
-	header, err := zip.FileInfoHeader(info)
+	req.Header.Set("Content-Type", getFileMIMEType(name))
+	req.Header.Set(s3ExpiresHeader, time.Now().Add(ttl).UTC().Format(time.RFC3339))
+	res, err := s.do(req, data)
 	if err != nil {
 		return err
 	}
+	res.Body.Close()
+	return nil
+}
 
-	// Using FileInfoHeader() above only uses the basename of the file.
-	// To reflect dir structure, set this to the full path.
-	header.Name = getFileNameFromPath(filePath, key)
-
-	// Change to deflate to gain better compression
-	// see http://golang.org/pkg/archive/zip/#pkg-constants
-	header.Method = zip.Deflate
+// Get : download the artifact unless it has expired
+func (s *S3ArtifactStore) Get(name string) ([]byte, error) {
+	req, err := s.newRequest(http.MethodGet, name, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := s.do(req, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if expires, err := time.Parse(time.RFC3339, res.Header.Get(s3ExpiresHeader)); err == nil && expires.Before(time.Now()) {
+		s.Delete(name)
+		return nil, errArtifactNotFound
+	}
+	return ioutil.ReadAll(res.Body)
+}
 
-	writer, err := zipWriter.CreateHeader(header)
+// Delete : remove the artifact from the bucket
+func (s *S3ArtifactStore) Delete(name string) error {
+	req, err := s.newRequest(http.MethodDelete, name, nil)
 	if err != nil {
 		return err
 	}
-	_, err = io.Copy(writer, fileToZip)
-	return err
+	res, err := s.do(req, nil)
+	if err == errArtifactNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	return nil
+}
+
+func (s *S3ArtifactStore) newRequest(method string, name string, data []byte) (*http.Request, error) {
+	if err := validateArtifactName(name); err != nil {
+		return nil, err
+	}
+	objectURL := fmt.Sprintf("%v/%v/%v", s.Endpoint, getURIEncodedPath(s.Bucket), getURIEncodedPath(name))
+	return http.NewRequest(method, objectURL, bytes.NewReader(data))
+}
+
+// sign and send a request, mapping missing objects to errArtifactNotFound
+func (s *S3ArtifactStore) do(req *http.Request, payload []byte) (*http.Response, error) {
+	signAWSRequest(req, payload, s.Region, "s3", s.AccessKeyID, s.SecretAccessKey, time.Now())
+	res, err := s.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode == http.StatusNotFound {
+		res.Body.Close()
+		return nil, errArtifactNotFound
+	}
+	if res.StatusCode >= 300 {
+		body, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+		res.Body.Close()
+		return nil, fmt.Errorf("s3 %v %v: %v %s", req.Method, req.URL.Path, res.Status, body)
+	}
+	return res, nil
+}
+
+// add AWS Signature Version 4 headers to a request, signing the host and every header already set
+// see https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-header-based-auth.html
+func signAWSRequest(req *http.Request, payload []byte, region string, service string, accessKeyID string, secretAccessKey string, t time.Time) {
+	amzDate := t.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	payloadHash := sha256.Sum256(payload)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payloadHash[:]))
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(strings.Join(v, ","))
+	}
+	var names []string
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		getURIEncodedPath(req.URL.Path),
+		getCanonicalQueryString(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+	canonicalRequestHash := sha256.Sum256([]byte(canonicalRequest))
+	scope := strings.Join([]string{date, region, service, "aws4_request"}, "/")
+	stringToSign := strings.Join([]string{"AWS4-HMAC-SHA256", amzDate, scope, hex.EncodeToString(canonicalRequestHash[:])}, "\n")
+
+	key := []byte("AWS4" + secretAccessKey)
+	for _, part := range []string{date, region, service, "aws4_request"} {
+		key = getHMACSHA256(key, part)
+	}
+	signature := hex.EncodeToString(getHMACSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%v/%v, SignedHeaders=%v, Signature=%v", accessKeyID, scope, signedHeaders, signature))
+}
+
+func getHMACSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// percent-encode everything but unreserved characters and slashes, as SigV4 requires
+func getURIEncodedPath(p string) string {
+	var b strings.Builder
+	for _, c := range []byte(p) {
+		if ('A' <= c && c <= 'Z') || ('a' <= c && c <= 'z') || ('0' <= c && c <= '9') || strings.IndexByte("-_.~/", c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func getCanonicalQueryString(query map[string][]string) string {
+	var params []string
+	for k, values := range query {
+		for _, v := range values {
+			params = append(params, strings.Replace(getURIEncodedPath(k), "/", "%2F", -1)+"="+strings.Replace(getURIEncodedPath(v), "/", "%2F", -1))
+		}
+	}
+	sort.Strings(params)
+	return strings.Join(params, "&")
 }
 
 func getAbsoluteURL(path string, query string) string {
@@ -871,70 +4223,274 @@ func getAbsoluteURL(path string, query string) string {
 	return fmt.Sprintf("%v://%v:%v/%v%v", protocol, domain, port, path, qs)
 }
 
-func errorResponse(w http.ResponseWriter, statusCode int, message string) {
+// take a request and the formats a route can produce and return the one its Accept header prefers.
+// Headers naming no audio type leave the choice to the route (""), headers naming only audio types
+// the route can't produce get a 406. At the same quality exact types win over audio/* and */*,
+// then types listed earlier in the header, then formats earlier in formats.
+func getAcceptedFormat(r *http.Request, formats []string) (string, *APIError) {
+	type mediaRange struct {
+		mediaType string
+		q         float64
+	}
+	accept := strings.Join(r.Header["Accept"], ",")
+	var ranges []mediaRange
+	namesAudio := false
+	for _, value := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(value))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if parsed, err := strconv.ParseFloat(v, 64); err == nil {
+				q = parsed
+			}
+		}
+		ranges = append(ranges, mediaRange{mediaType, q})
+		namesAudio = namesAudio || strings.HasPrefix(mediaType, "audio/")
+	}
+	if !namesAudio {
+		return "", nil
+	}
+	best, bestQ, bestSpecificity, bestPos := "", 0.0, -1, len(ranges)
+	for _, format := range formats {
+		// the most specific range matching the format sets its quality
+		q, specificity, pos := 0.0, -1, len(ranges)
+		for i, mr := range ranges {
+			s := -1
+			switch {
+			case audioMediaTypes[mr.mediaType] == format:
+				s = 2
+			case mr.mediaType == "audio/*":
+				s = 1
+			case mr.mediaType == "*/*":
+				s = 0
+			}
+			if s > specificity || (s == specificity && s >= 0 && mr.q > q) {
+				q, specificity, pos = mr.q, s, i
+			}
+		}
+		if q <= 0 {
+			continue
+		}
+		if q > bestQ || (q == bestQ && (specificity > bestSpecificity || (specificity == bestSpecificity && pos < bestPos))) {
+			best, bestQ, bestSpecificity, bestPos = format, q, specificity, pos
+		}
+	}
+	if best == "" {
+		var mediaTypes []string
+		for _, format := range formats {
+			mediaTypes = append(mediaTypes, fileFormats[format].MIMEType)
+		}
+		return "", newAPIError(http.StatusNotAcceptable, errCodeNotAcceptable,
+			fmt.Sprintf("Accept %q allows none of the output formats %v", accept, strings.Join(mediaTypes, ", ")))
+	}
+	return best, nil
+}
+
+// take a file name and return the MIME type of its output format
+func getFileMIMEType(fileName string) string {
+	ext := strings.TrimPrefix(path.Ext(fileName), ".")
+	for _, f := range fileFormats {
+		if f.Extension == ext {
+			return f.MIMEType
+		}
+	}
+	return "application/octet-stream"
+}
+
+func errorResponse(w http.ResponseWriter, apiErr *APIError) {
 	var jsonData []byte
 	tsCreated := time.Now()
-	data := APIResponse{URL: "", CreatedTimeStamp: tsCreated, Success: false, Message: message}
+	data := APIResponse{URL: "", CreatedTimeStamp: tsCreated, Success: false, Message: apiErr.Message, Error: apiErr}
 	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(statusCode)
+	w.WriteHeader(apiErr.Status)
 	jsonData, _ = json.MarshalIndent(data, "", "    ")
 	w.Write(jsonData)
 }
 
-func conversionResponse(w http.ResponseWriter, outputFilePath string, fileName string) {
-	data := APIResponse{}
+func newAPIError(status int, code string, message string) *APIError {
+	return &APIError{Status: status, Code: code, Message: message}
+}
+
+func (e *APIError) Error() string {
+	if e.Field != "" {
+		return fmt.Sprintf("%v: %v: %v", e.Code, e.Field, e.Message)
+	}
+	return fmt.Sprintf("%v: %v", e.Code, e.Message)
+}
+
+func (e *APIError) Unwrap() error {
+	return e.err
+}
+
+// take an error from a stage of the conversion pipeline and return it as an API error with the stage's code
+func newConversionError(code string, err error) *APIError {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr
+	}
+	return &APIError{Status: http.StatusUnprocessableEntity, Code: code, Message: err.Error(), err: err}
+}
+
+// take any error and return the API error it maps to,
+// checking the most specific failures first since they may be wrapped in more general ones
+func getAPIError(err error) *APIError {
+	var timeoutErr *renderTimeoutError
+	if errors.As(err, &timeoutErr) {
+		return &APIError{Status: http.StatusGatewayTimeout, Code: errCodeRenderTimeout, err: err,
+			Message: fmt.Sprintf("Conversion exceeded the maximum render time of %v, %v", getMaxRenderTime(), err)}
+	}
+	var validationErrs ValidationErrors
+	if errors.As(err, &validationErrs) {
+		return newValidationAPIError(validationErrs, errCodeInvalidMotif, "invalid motif")
+	}
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr
+	}
+	return &APIError{Status: http.StatusInternalServerError, Code: errCodeInternal, Message: err.Error(), err: err}
+}
+
+// take validation problems and return a 400 error with every problem in its details
+func newValidationAPIError(errs ValidationErrors, code string, subject string) *APIError {
+	apiErr := &APIError{Status: http.StatusBadRequest, Code: code, err: errs,
+		Message: fmt.Sprintf("%v: %v", subject, errs)}
+	for _, e := range errs {
+		detail := &APIError{Status: http.StatusBadRequest, Code: code, Message: e.Message, Field: e.Field}
+		if e.NoteIndex >= 0 {
+			noteIndex := e.NoteIndex
+			detail.NoteIndex = &noteIndex
+		}
+		apiErr.Details = append(apiErr.Details, detail)
+	}
+	return apiErr
+}
+
+// take the name of a converted file and return a unique name to store it under
+func getArtifactName(name string) string {
+	_, artifactName := getFilePathFromName("", getRandomString(8), getSafeFileName(name), fileFormats[zipFile].Extension)
+	return artifactName
+}
+
+// store a converted file for download and return its URL
+func storeArtifact(fileName string, data []byte) (string, error) {
+	store, err := getArtifactStore()
+	if err != nil {
+		return "", err
+	}
+	if err := store.Put(fileName, data, time.Minute*time.Duration(downloadTTLMins)); err != nil {
+		return "", err
+	}
+	// fileURL := getAbsoluteURL("convertor/files/"+fileName, "")
+	return "/api/convertor/files/" + fileName, nil
+}
+
+// store the converted file and respond with the URL it can be downloaded from
+func conversionResponse(w http.ResponseWriter, fileName string, data []byte) {
 	tsCreated := time.Now()
-	// conversion failed
-	if outputFilePath == "" {
-		errorResponse(w, http.StatusUnprocessableEntity, "Conversion failed")
-	} else {
-		tsExpires := tsCreated.Local().Add(time.Minute * time.Duration(downloadTTLMins))
-		strExpires := tsExpires.Format(time.RFC1123)
-		// fileURL := getAbsoluteURL("convertor/"+fileName, "")
-		fileURL := "/api/convertor/" + fileName
-		data = APIResponse{URL: fileURL, CreatedTimeStamp: tsCreated, Success: true, Message: "File converted"}
-		fmt.Println(strExpires)
-		w.Header().Set("Expires", strExpires)
-		w.WriteHeader(http.StatusOK)
+	fileURL, err := storeArtifact(fileName, data)
+	if err != nil {
+		fmt.Println("ERROR: storing converted file", err)
+		errorResponse(w, &APIError{Status: http.StatusInternalServerError, Code: errCodeStorageFailed, Message: "Storing the converted file failed", err: err})
+		return
 	}
-	var jsonData []byte
-	jsonData, _ = json.MarshalIndent(data, "", "    ")
+	tsExpires := tsCreated.Local().Add(time.Minute * time.Duration(downloadTTLMins))
+	strExpires := tsExpires.Format(time.RFC1123)
+	data, _ = json.MarshalIndent(APIResponse{URL: fileURL, CreatedTimeStamp: tsCreated, Success: true, Message: "File converted"}, "", "    ")
+	fmt.Println(strExpires)
+	w.Header().Set("Expires", strExpires)
 	w.Header().Set("Content-Type", "application/json")
-	w.Write(jsonData)
-	go expireFile(outputFilePath)
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+// respond to a failed conversion, with a 504 and how far it got when it ran out of time
+func renderErrorResponse(w http.ResponseWriter, r *http.Request, err error) {
+	fmt.Println("ERROR: conversion", err)
+	if r.Context().Err() != nil {
+		fmt.Println("Client went away, conversion cancelled")
+		return
+	}
+	errorResponse(w, getAPIError(err))
 }
 
-func serveDownloadFile(w http.ResponseWriter, r *http.Request, filePath string, fileName string) {
-	// tell the browser the returned content should be downloaded
+// stream an in-memory file to the client as a download
+func serveDownloadData(w http.ResponseWriter, data []byte, fileName string) {
 	contentDisposition := fmt.Sprintf("attachment; filename=\"%v\"", fileName)
-	w.Header().Add("Content-Disposition", contentDisposition)
-	http.ServeFile(w, r, filePath)
-}
-
-func fileDownloadHandler(w http.ResponseWriter, r *http.Request) {
-	paths := strings.Split(r.URL.Path, "/")
-	fileName := paths[2:]
-	if len(fileName) == 1 {
-		fileName := fileName[0]
-		userFileName := strings.Split(fileName, "_")[1]
-		downloadFilePath := outputFileDir + fileName
-		if fileExists(downloadFilePath) {
-			serveDownloadFile(w, r, downloadFilePath, userFileName)
-		} else {
-			fmt.Println("Requested file does not exist or has expired")
-			errorResponse(w, http.StatusNotFound, fmt.Sprintf("requested file %v does not exist or has expired", downloadFilePath))
-		}
-	} else {
+	w.Header().Set("Content-Disposition", contentDisposition)
+	w.Header().Set("Content-Type", getFileMIMEType(fileName))
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+func fileDownloadHandler(w http.ResponseWriter, r *http.Request, fileName string) {
+	if !strings.Contains(fileName, "_") {
 		fmt.Println("Bad request path")
-		errorResponse(w, http.StatusNotFound, "Bad request path - no file name")
+		errorResponse(w, newAPIError(http.StatusNotFound, errCodeNotFound, "Bad request path - no file name"))
+		return
+	}
+	userFileName := strings.SplitN(fileName, "_", 2)[1]
+	store, err := getArtifactStore()
+	if err != nil {
+		fmt.Println("ERROR: getArtifactStore", err)
+		errorResponse(w, &APIError{Status: http.StatusInternalServerError, Code: errCodeStorageFailed, Message: "File storage is misconfigured", err: err})
+		return
+	}
+	data, err := store.Get(fileName)
+	if err == errArtifactNotFound || err == errInvalidArtifactName {
+		fmt.Println("Requested file does not exist or has expired")
+		errorResponse(w, newAPIError(http.StatusNotFound, errCodeNotFound, fmt.Sprintf("requested file %v does not exist or has expired", fileName)))
+	} else if err != nil {
+		fmt.Println("ERROR: fetching stored file", err)
+		errorResponse(w, &APIError{Status: http.StatusBadGateway, Code: errCodeStorageFailed, Message: fmt.Sprintf("requested file %v could not be fetched", fileName), err: err})
+	} else {
+		serveDownloadData(w, data, userFileName)
 	}
 }
 
-func midiFileUploadHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != "POST" {
-		errorResponse(w, http.StatusNotAcceptable, fmt.Sprintf(r.Method, "not accepted at upload endpoint"))
+// respond with the Motivic JSON representation of an uploaded MIDI or JSON file
+func uploadedFileJSONResponse(ctx context.Context, w http.ResponseWriter, inputFileName string, inputData []byte, motifName string) {
+	motifs, err := parseUploadedFile(ctx, inputFileName, inputData)
+	if err == nil && len(motifs) == 0 {
+		err = newAPIError(http.StatusUnprocessableEntity, errCodeParseFailed, "file contains no motifs")
+	}
+	if err != nil {
+		fmt.Println("ERROR: parseUploadedFile() ", err)
+		errorResponse(w, getAPIError(newConversionError(errCodeParseFailed, err)))
+		return
+	}
+	jsonData, err := motifJSONMap(getNamedMotifs(motifs, motifName, getUploadedFileType(inputFileName)))
+	if err != nil {
+		fmt.Println("ERROR: motifJSONMap", err)
+		errorResponse(w, newConversionError(errCodeEncodingFailed, err))
+		return
 	}
-	fmt.Println("MIDI File Upload Endpoint Hit")
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonData)
+}
+
+// uploadRequest : the uploaded file and conversion settings of the upload form
+type uploadRequest struct {
+	FileName      string
+	Data          []byte
+	OutputName    string
+	OutputFormat  string
+	WaveForm      string
+	Sampler       *Sampler // uploaded samples played instead of the wave form
+	RenderOptions RenderOptions
+}
+
+// return the voice the upload's motifs are rendered with
+func (u uploadRequest) voice() voiceSettings {
+	return voiceSettings{Name: u.WaveForm, Sampler: u.Sampler}
+}
+
+// take a multipart upload and return its file and settings, responding with an error when it is invalid
+func parseUploadRequest(w http.ResponseWriter, r *http.Request) (uploadRequest, bool) {
+	var u uploadRequest
 	// 1. PARSE UPLOADED FILE
 	fmt.Println("Parsing uploaded file...")
 	tsCreated := time.Now()
@@ -945,7 +4501,8 @@ func midiFileUploadHandler(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		errMsg := fmt.Sprintf("Error parsing the file upload %s", err)
 		fmt.Println(errMsg)
-		errorResponse(w, http.StatusUnprocessableEntity, errMsg)
+		errorResponse(w, &APIError{Status: http.StatusUnprocessableEntity, Code: errCodeInvalidUpload, Field: "myMIDIFile", Message: errMsg, err: err})
+		return u, false
 	}
 	defer midiFile.Close()
 	fmt.Printf("Uploaded File: \t%+v at %v\n", midiFileHandle.Filename, tsCreated)
@@ -953,50 +4510,137 @@ func midiFileUploadHandler(w http.ResponseWriter, r *http.Request) {
 	fmt.Printf("MIME Header: \t%+v\n", midiFileHandle.Header)
 	fmt.Println("Successfully uploaded file")
 
-	// 2. SAVE UPLOADED MIDI FILE TO DISK
-	randomString := getRandomString(8)
-	inputFilePath := inputFileDir + randomString + "_" + midiFileHandle.Filename
-	saveFile(midiFile, midiFileHandle, inputFilePath)
-	go expireFile(inputFilePath)
-
-	// 3. CONVERT MIDI FILE TO AUDIO FILE
-	fmt.Println("Converting copied file...")
-	waveFormName := r.Form.Get("myWaveForm")
-	outputFileName := r.Form.Get("wavFileName")
-	wavFileoutputFilePath, _ := getFilePathFromName(outputFileDir, randomString, outputFileName, "wav")
-	// channel to wait for go routine response
-	c := make(chan bool)
-	go convertMIDIFileToWAVFile(inputFilePath, wavFileoutputFilePath, waveFormName, c)
-	success := <-c
-	go expireFile(wavFileoutputFilePath)
-
-	// 4. RETURN URL OF NEW FILE
-	var zipFileOutputPath string = ""
-	var zipFileName string = ""
-	if success {
-		zipFileOutputPath, zipFileName = getFilePathFromName(outputFileDir, randomString, outputFileName, "zip")
-		filesToZip := []string{wavFileoutputFilePath}
-		if err := zipFiles(zipFileOutputPath, filesToZip, randomString); err != nil {
-			panic(err)
-		}
-		fmt.Println("Zipped File:", zipFileOutputPath)
-	}
-	conversionResponse(w, zipFileOutputPath, zipFileName)
+	// 2. READ UPLOADED MIDI OR JSON FILE INTO MEMORY
+	u.Data, err = ioutil.ReadAll(midiFile)
+	if err != nil {
+		errorResponse(w, &APIError{Status: http.StatusUnprocessableEntity, Code: errCodeInvalidUpload, Field: "myMIDIFile", Message: fmt.Sprintf("Error reading the file upload %s", err), err: err})
+		return u, false
+	}
+	u.FileName = midiFileHandle.Filename
+
+	// 3. READ CONVERSION SETTINGS
+	u.WaveForm = r.Form.Get("myWaveForm")
+	u.OutputName = r.Form.Get("wavFileName")
+	u.OutputFormat = r.Form.Get("myOutputFormat")
+	if u.OutputFormat == "" {
+		var apiErr *APIError
+		if u.OutputFormat, apiErr = getAcceptedFormat(r, []string{wavFile, aiffFile, flacFile}); apiErr != nil {
+			errorResponse(w, apiErr)
+			return u, false
+		}
+	}
+	if u.OutputFormat == "" {
+		u.OutputFormat = wavFile
+	}
+	if u.OutputFormat != wavFile && u.OutputFormat != aiffFile && u.OutputFormat != flacFile && u.OutputFormat != jsonFile {
+		errorResponse(w, &APIError{Status: http.StatusBadRequest, Code: errCodeUnsupportedFormat, Field: "myOutputFormat", Message: fmt.Sprintf("Unsupported output format %q", u.OutputFormat)})
+		return u, false
+	}
+	u.RenderOptions, err = getFormRenderOptions(r, u.OutputFormat)
+	if err != nil {
+		errorResponse(w, getAPIError(err))
+		return u, false
+	}
+	if u.OutputFormat != jsonFile {
+		var apiErr *APIError
+		if u.Sampler, apiErr = getFormSampler(r); apiErr != nil {
+			errorResponse(w, apiErr)
+			return u, false
+		}
+	}
+	return u, true
+}
+
+// take an upload and return its conversion, responding with an error when the uploaded file is invalid
+func getUploadConversion(w http.ResponseWriter, u uploadRequest) (conversion, bool) {
+	cv := conversion{Name: getSafeFileName(u.OutputName)}
+	if u.OutputFormat == jsonFile {
+		outputFile := newMemoryFile(u.OutputName, fileFormats[jsonFile].Extension)
+		cv.Files = append(cv.Files, outputFile)
+		cv.Steps = append(cv.Steps, conversionStep{outputFile.name, func(ctx context.Context, c chan<- error) {
+			convertFileToJSONFile(ctx, u.FileName, u.Data, outputFile, u.OutputName, c)
+		}})
+	} else if getUploadedFileType(u.FileName) == jsonFile {
+		// parse up front so validation problems can be reported to the client
+		motifs, err := parseJSONFile(u.Data)
+		if err != nil {
+			fmt.Println("ERROR: parseJSONFile()", err)
+			errorResponse(w, getAPIError(err))
+			return cv, false
+		}
+		// render each motif of the Motivic.json file to its own audio file
+		for i, motif := range motifs {
+			name := u.OutputName
+			if len(motifs) > 1 {
+				name = fmt.Sprintf("%v_%d", u.OutputName, i+1)
+			}
+			outputFile := newMemoryFile(name, fileFormats[u.OutputFormat].Extension)
+			motif := motif
+			cv.Files = append(cv.Files, outputFile)
+			cv.Steps = append(cv.Steps, conversionStep{outputFile.name, func(ctx context.Context, c chan<- error) {
+				convertMotifToAudioFile(ctx, motif, outputFile, u.OutputFormat, u.voice(), u.RenderOptions, c)
+			}})
+		}
+	} else {
+		outputFile := newMemoryFile(u.OutputName, fileFormats[u.OutputFormat].Extension)
+		cv.Files = append(cv.Files, outputFile)
+		cv.Steps = append(cv.Steps, conversionStep{outputFile.name, func(ctx context.Context, c chan<- error) {
+			convertMIDIFileToAudioFile(ctx, u.Data, outputFile, u.OutputFormat, u.voice(), u.RenderOptions, c)
+		}})
+	}
+	return cv, true
 }
 
-func jsonDataConversionHandler(w http.ResponseWriter, r *http.Request) {
-	// 1. CONVERT JSON REQUEST BODY TO MOTIF STRUCT
+func midiFileUploadHandler(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("MIDI/JSON File Upload Endpoint Hit")
+	u, ok := parseUploadRequest(w, r)
+	if !ok {
+		return
+	}
+	if u.OutputFormat == jsonFile && r.Form.Get("myInlineJSON") == "true" {
+		uploadedFileJSONResponse(r.Context(), w, u.FileName, u.Data, u.OutputName)
+		return
+	}
+
+	// 4. CONVERT MIDI OR JSON FILE TO AUDIO OR JSON FILE
+	fmt.Println("Converting uploaded file...")
+	cv, ok := getUploadConversion(w, u)
+	if !ok {
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), getMaxRenderTime())
+	defer cancel()
+	if err := cv.render(ctx); err != nil {
+		renderErrorResponse(w, r, err)
+		return
+	}
+
+	// 5. RETURN THE ZIPPED FILES INLINE OR THE URL OF THE ZIP FILE
+	zipData, err := zipFiles(cv.Files)
+	if err != nil {
+		fmt.Println("ERROR: zipFiles", err)
+		errorResponse(w, &APIError{Status: http.StatusInternalServerError, Code: errCodeEncodingFailed, Message: "Zipping the converted files failed", err: err})
+		return
+	}
+	if r.Form.Get("myInlineDownload") == "true" {
+		serveDownloadData(w, zipData, cv.Name+"."+fileFormats[zipFile].Extension)
+		return
+	}
+	zipFileName := getArtifactName(cv.Name)
+	fmt.Println("Zipped File:", zipFileName)
+	conversionResponse(w, zipFileName, zipData)
+}
 
+// decode a JSON request body into v, responding with an error when it can't be decoded
+func decodeJSONRequestBody(w http.ResponseWriter, r *http.Request, v interface{}) bool {
 	// Use http.MaxBytesReader to enforce a maximum read of 1MB from the
 	// request body. A request body larger than that will now result in
 	// Decode() returning a "http: request body too large" error.
-	r.Body = http.MaxBytesReader(w, r.Body, 1048576)
+	r.Body = http.MaxBytesReader(w, r.Body, maxJSONBodySizeBytes)
 	dec := json.NewDecoder(r.Body)
 
-	var b JSONConversionRequestBody
-
 	fmt.Println("beginning to decode JSON")
-	err := dec.Decode(&b)
+	err := dec.Decode(v)
 	if err != nil {
 		var syntaxError *json.SyntaxError
 		var unmarshalTypeError *json.UnmarshalTypeError
@@ -1009,7 +4653,7 @@ func jsonDataConversionHandler(w http.ResponseWriter, r *http.Request) {
 		// easier for the client to fix.
 		case errors.As(err, &syntaxError):
 			msg := fmt.Sprintf("Request body contains badly-formed JSON (at position %d): %s", syntaxError.Offset, err)
-			http.Error(w, msg, http.StatusBadRequest)
+			errorResponse(w, newAPIError(http.StatusBadRequest, errCodeInvalidJSON, msg))
 
 		// In some circumstances Decode() may also return an
 		// io.ErrUnexpectedEOF error for syntax errors in the JSON. There
@@ -1017,7 +4661,7 @@ func jsonDataConversionHandler(w http.ResponseWriter, r *http.Request) {
 		// https://github.com/golang/go/issues/25956.
 		case errors.Is(err, io.ErrUnexpectedEOF):
 			msg := fmt.Sprintf("Request body contains badly-formed JSON")
-			http.Error(w, msg, http.StatusBadRequest)
+			errorResponse(w, newAPIError(http.StatusBadRequest, errCodeInvalidJSON, msg))
 
 		// Catch any type errors, like trying to assign a string in the
 		// JSON request body to a int field in the Motif struct. We can
@@ -1025,113 +4669,598 @@ func jsonDataConversionHandler(w http.ResponseWriter, r *http.Request) {
 		// message to make it easier for the client to fix.
 		case errors.As(err, &unmarshalTypeError):
 			msg := fmt.Sprintf("Request body contains an invalid value for the %q field (at position %d)", unmarshalTypeError.Field, unmarshalTypeError.Offset)
-			http.Error(w, msg, http.StatusBadRequest)
+			errorResponse(w, &APIError{Status: http.StatusBadRequest, Code: errCodeInvalidValue, Field: unmarshalTypeError.Field, Message: msg})
 
 		// An io.EOF error is returned by Decode() if the request body is
 		// empty.
 		case errors.Is(err, io.EOF):
 			msg := "Request body must not be empty"
-			http.Error(w, msg, http.StatusBadRequest)
+			errorResponse(w, newAPIError(http.StatusBadRequest, errCodeEmptyBody, msg))
 
 		// Catch the error caused by the request body being too large. Again
 		// there is an open issue regarding turning this into a sentinel
 		// error at https://github.com/golang/go/issues/30715.
 		case err.Error() == "http: request body too large":
 			msg := "Request body must not be larger than 1MB"
-			http.Error(w, msg, http.StatusRequestEntityTooLarge)
+			errorResponse(w, newAPIError(http.StatusRequestEntityTooLarge, errCodeBodyTooLarge, msg))
 
 		// Otherwise default to logging the error and sending a 500 Internal
 		// Server Error response.
 		default:
 			log.Println(err.Error())
-			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			errorResponse(w, &APIError{Status: http.StatusInternalServerError, Code: errCodeInternal, Message: http.StatusText(http.StatusInternalServerError), err: err})
 		}
-		return
+		return false
+	}
+	return true
+}
+
+// take a JSON conversion request and return its conversion, responding with an error when it is invalid
+func getJSONConversion(w http.ResponseWriter, r *http.Request) (conversion, bool) {
+	// 1. CONVERT JSON REQUEST BODY TO MOTIF STRUCT
+	var b JSONConversionRequestBody
+	if !decodeJSONRequestBody(w, r, &b) {
+		return conversion{}, false
 	}
 
 	message := fmt.Sprintf("SUCCESS! Motif %v deserialized from JSON", b.Motif.Name)
 	fmt.Println(message)
+	if errs := b.Motif.Validate(); len(errs) > 0 {
+		fmt.Println("Motif failed validation", errs)
+		errorResponse(w, getAPIError(errs.withPrefix("motif.")))
+		return conversion{}, false
+	}
+	// clients may only send note values and durations
+	b.Motif = b.Motif.Normalized()
+	if b.Envelope != nil {
+		if err := b.Envelope.validate(); err != nil {
+			errorResponse(w, getAPIError(err))
+			return conversion{}, false
+		}
+	}
+	if b.Pluck != nil {
+		if err := b.Pluck.validate(); err != nil {
+			errorResponse(w, getAPIError(err))
+			return conversion{}, false
+		}
+	}
+	if b.FM != nil {
+		if errs := b.FM.Validate(); len(errs) > 0 {
+			errorResponse(w, newValidationAPIError(errs.withPrefix("fm."), errCodeInvalidVoice, "invalid FM voice"))
+			return conversion{}, false
+		}
+	}
 
-	// 2. CONVERT MOTIF TO AUDIO FILE
-	fmt.Println("Converting Motif...")
+	// 2. CHOOSE OUTPUT FILE
 	var outputFileName string = "my-motif"
 	if len(b.Motif.Name) > 0 {
 		outputFileName = b.Motif.Name
 	}
-	randomString := getRandomString(8)
-	// TODO: forego writing files to disk: keep bytes in memory and return a blob?
-	wavFileoutputFilePath, _ := getFilePathFromName(outputFileDir, randomString, outputFileName, "wav")
-	// channel to wait for go routine response
-	c := make(chan bool)
-	go convertMotifToWAVFile(b.Motif, wavFileoutputFilePath, b.Voice, c)
-	success := <-c
-	go expireFile(wavFileoutputFilePath)
-
-	// 3. RETURN NEW AUDIO FILE
-	var zipFileOutputPath string = ""
-	var zipFileName string = ""
-	if success {
-		zipFileOutputPath, zipFileName = getFilePathFromName(outputFileDir, randomString, outputFileName, "zip")
-		filesToZip := []string{wavFileoutputFilePath}
-		if err := zipFiles(zipFileOutputPath, filesToZip, randomString); err != nil {
-			panic(err)
-		}
-		fmt.Println("Zipped File:", zipFileOutputPath)
-		serveDownloadFile(w, r, zipFileOutputPath, zipFileName)
+	outputFormat := b.Format
+	if outputFormat == "" {
+		var apiErr *APIError
+		if outputFormat, apiErr = getAcceptedFormat(r, []string{wavFile, aiffFile, flacFile, midiFile}); apiErr != nil {
+			errorResponse(w, apiErr)
+			return conversion{}, false
+		}
+	}
+	if outputFormat == "" {
+		outputFormat = wavFile
+	}
+	if outputFormat != wavFile && outputFormat != aiffFile && outputFormat != flacFile && outputFormat != midiFile {
+		errorResponse(w, &APIError{Status: http.StatusBadRequest, Code: errCodeUnsupportedFormat, Field: "format", Message: fmt.Sprintf("Unsupported output format %q", b.Format)})
+		return conversion{}, false
+	}
+	renderOptions := b.Render.withDefaults()
+	if err := renderOptions.validate(outputFormat); err != nil {
+		apiErr := err.(*APIError)
+		apiErr.Field = "render." + apiErr.Field
+		errorResponse(w, apiErr)
+		return conversion{}, false
+	}
+	if outputFormat == midiFile {
+		if errs := b.Motif.ValidateMIDI(); len(errs) > 0 {
+			fmt.Println("Motif failed MIDI validation", errs)
+			errorResponse(w, getAPIError(errs.withPrefix("motif.")))
+			return conversion{}, false
+		}
+	}
+	outputFile := newMemoryFile(outputFileName, fileFormats[outputFormat].Extension)
+	cv := conversion{Name: getSafeFileName(outputFileName), Files: []*memoryFile{outputFile}}
+	if outputFormat == midiFile {
+		cv.Steps = append(cv.Steps, conversionStep{outputFile.name, func(ctx context.Context, c chan<- error) {
+			convertMotifToMIDIFile(ctx, b.Motif, outputFile, c)
+		}})
+	} else {
+		cv.Steps = append(cv.Steps, conversionStep{outputFile.name, func(ctx context.Context, c chan<- error) {
+			convertMotifToAudioFile(ctx, b.Motif, outputFile, outputFormat, voiceSettings{Name: b.Voice, Envelope: b.Envelope, Pluck: b.Pluck, FM: b.FM}, renderOptions, c)
+		}})
+	}
+	return cv, true
+}
+
+func jsonDataConversionHandler(w http.ResponseWriter, r *http.Request) {
+	cv, ok := getJSONConversion(w, r)
+	if !ok {
+		return
+	}
+
+	// 3. CONVERT MOTIF TO AUDIO OR MIDI FILE
+	fmt.Println("Converting Motif...")
+	renderConversionResponse(w, r, cv)
+}
+
+// render the conversion and respond with its zipped files
+func renderConversionResponse(w http.ResponseWriter, r *http.Request, cv conversion) {
+	ctx, cancel := context.WithTimeout(r.Context(), getMaxRenderTime())
+	defer cancel()
+	if err := cv.render(ctx); err != nil {
+		renderErrorResponse(w, r, err)
+		return
+	}
+
+	// 4. RETURN NEW FILE
+	zipData, err := zipFiles(cv.Files)
+	if err != nil {
+		fmt.Println("ERROR: zipFiles", err)
+		errorResponse(w, &APIError{Status: http.StatusInternalServerError, Code: errCodeEncodingFailed, Message: "Zipping the converted file failed", err: err})
+		return
+	}
+	serveDownloadData(w, zipData, cv.Name+"."+fileFormats[zipFile].Extension)
+}
+
+// Validate : check the layers and their motifs, returning every problem found
+func (b MixdownRequestBody) Validate() ValidationErrors {
+	var errs ValidationErrors
+	if len(b.Layers) == 0 || len(b.Layers) > maxMixLayers {
+		errs = append(errs, ValidationError{"layers", -1, fmt.Sprintf("must hold 1 to %d layers", maxMixLayers)})
+	}
+	if b.HeadroomDB != nil && (*b.HeadroomDB < 0 || *b.HeadroomDB > maxMixHeadroomDB) {
+		errs = append(errs, ValidationError{"headroomDb", -1, fmt.Sprintf("must be between 0 and %v", maxMixHeadroomDB)})
+	}
+	for i, l := range b.Layers {
+		field := fmt.Sprintf("layers[%d].", i)
+		if l.GainDB < minLayerGainDB || l.GainDB > maxLayerGainDB {
+			errs = append(errs, ValidationError{field + "gainDb", -1, fmt.Sprintf("must be between %v and %v", minLayerGainDB, maxLayerGainDB)})
+		}
+		if l.Pan < -1 || l.Pan > 1 {
+			errs = append(errs, ValidationError{field + "pan", -1, "must be between -1 (left) and 1 (right)"})
+		}
+		if l.Offset < 0 {
+			errs = append(errs, ValidationError{field + "offset", -1, "must not be negative"})
+		}
+		if l.Envelope != nil {
+			if err := l.Envelope.validate(); err != nil {
+				errs = append(errs, ValidationError{field + "envelope", -1, err.(*APIError).Message})
+			}
+		}
+		if l.Pluck != nil {
+			if err := l.Pluck.validate(); err != nil {
+				errs = append(errs, ValidationError{field + err.(*APIError).Field, -1, err.(*APIError).Message})
+			}
+		}
+		if l.FM != nil {
+			errs = append(errs, l.FM.Validate().withPrefix(field+"fm.")...)
+		}
+		errs = append(errs, l.Motif.Validate().withPrefix(field+"motif.")...)
+	}
+	return errs
+}
+
+// take a mixdown request and return its conversion, responding with an error when it is invalid
+func getMixdownConversion(w http.ResponseWriter, r *http.Request) (conversion, bool) {
+	var b MixdownRequestBody
+	if !decodeJSONRequestBody(w, r, &b) {
+		return conversion{}, false
+	}
+	if errs := b.Validate(); len(errs) > 0 {
+		fmt.Println("Mixdown failed validation", errs)
+		errorResponse(w, newValidationAPIError(errs, errCodeInvalidMixdown, "invalid mixdown"))
+		return conversion{}, false
+	}
+
+	outputFormat := b.Format
+	if outputFormat == "" {
+		var apiErr *APIError
+		if outputFormat, apiErr = getAcceptedFormat(r, []string{wavFile, aiffFile, flacFile}); apiErr != nil {
+			errorResponse(w, apiErr)
+			return conversion{}, false
+		}
+	}
+	if outputFormat == "" {
+		outputFormat = wavFile
+	}
+	if outputFormat != wavFile && outputFormat != aiffFile && outputFormat != flacFile {
+		errorResponse(w, &APIError{Status: http.StatusBadRequest, Code: errCodeUnsupportedFormat, Field: "format", Message: fmt.Sprintf("Unsupported output format %q", b.Format)})
+		return conversion{}, false
+	}
+	renderOptions := b.Render
+	if renderOptions.Channels == 0 {
+		renderOptions.Channels = 2
+	}
+	renderOptions = renderOptions.withDefaults()
+	if err := renderOptions.validate(outputFormat); err != nil {
+		apiErr := err.(*APIError)
+		apiErr.Field = "render." + apiErr.Field
+		errorResponse(w, apiErr)
+		return conversion{}, false
+	}
+	headroomDB := defaultMixHeadroomDB
+	if b.HeadroomDB != nil {
+		headroomDB = *b.HeadroomDB
+	}
+	name := "my-mixdown"
+	if len(b.Name) > 0 {
+		name = b.Name
+	}
+
+	// layers render one step at a time, then get mixed and encoded together
+	ext := fileFormats[outputFormat].Extension
+	mixFile := newMemoryFile(name, ext)
+	cv := conversion{Name: getSafeFileName(name), Files: []*memoryFile{mixFile}}
+	var stemFiles []*memoryFile
+	layerData := make([][]float64, len(b.Layers))
+	layerOptions := renderOptions
+	layerOptions.Channels = 1
+	for i := range b.Layers {
+		i, layer := i, b.Layers[i]
+		// clients may only send note values and durations
+		layer.Motif = layer.Motif.Normalized()
+		b.Layers[i] = layer
+		if b.Stems {
+			stemName := fmt.Sprintf("%v_stem-%d", name, i+1)
+			if layer.Motif.Name != "" {
+				stemName += "_" + layer.Motif.Name
+			}
+			stemFiles = append(stemFiles, newMemoryFile(stemName, ext))
+		}
+		cv.Steps = append(cv.Steps, conversionStep{fmt.Sprintf("layer %d", i+1), func(ctx context.Context, c chan<- error) {
+			bufs, err := motifAudioMap(ctx, layer.Motif, voiceSettings{Name: layer.Voice, Envelope: layer.Envelope, Pluck: layer.Pluck, FM: layer.FM}, layerOptions)
+			if err != nil {
+				fmt.Println("ERROR: motifAudioMap", err)
+				c <- newConversionError(errCodeSynthesisFailed, err)
+				return
+			}
+			layerData[i] = bufs[0].Data
+			c <- nil
+		}})
+	}
+	cv.Files = append(cv.Files, stemFiles...)
+	cv.Steps = append(cv.Steps, conversionStep{mixFile.name, func(ctx context.Context, c chan<- error) {
+		convertLayersToAudioFiles(ctx, b.Layers, layerData, mixFile, stemFiles, outputFormat, headroomDB, renderOptions, c)
+	}})
+	return cv, true
+}
+
+func mixdownHandler(w http.ResponseWriter, r *http.Request) {
+	cv, ok := getMixdownConversion(w, r)
+	if !ok {
+		return
+	}
+	fmt.Println("Mixing motifs...")
+	renderConversionResponse(w, r, cv)
+}
+
+// peek at a JSON job submission and tell whether it's a mixdown, which has layers instead of a motif
+func isMixdownRequest(r *http.Request) bool {
+	data, _ := ioutil.ReadAll(io.LimitReader(r.Body, maxJSONBodySizeBytes+1))
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(data), r.Body), r.Body}
+	var probe struct {
+		Layers json.RawMessage `json:"layers"`
+	}
+	return json.Unmarshal(data, &probe) == nil && probe.Layers != nil
+}
+
+// ConversionJob : a conversion whose result is kept for polling at /api/convertor/jobs/{id}
+type ConversionJob struct {
+	ID       string    `json:"id"`
+	State    string    `json:"state"`
+	Progress float64   `json:"progress"`
+	Error    *APIError `json:"error,omitempty"`
+	URL      string    `json:"url,omitempty"`
+	Created  time.Time `json:"created"`
+	Updated  time.Time `json:"updated"`
+}
+
+// conversion jobs states
+const jobRunning string = "running"
+const jobSucceeded string = "succeeded"
+const jobFailed string = "failed"
+
+// job IDs are 128 random bits, so jobs can't be guessed or collide
+const conversionJobIDBytes int = 16
+
+// jobs render while their submission waits, since serverless instances may be frozen as soon as
+// they respond, and submissions are refused while the maximum number of jobs is rendering
+const maxConversionJobs int = 4
+
+var conversionJobSlots = make(chan struct{}, maxConversionJobs)
+
+// job records are kept in the artifact store so any instance can report them,
+// under names the download route refuses as they have no "_"
+func getJobRecordName(id string) string {
+	return "job-" + id + ".json"
+}
+
+// take a job, stamp its update time and save its record for as long as its file can be downloaded
+func saveConversionJob(job *ConversionJob) error {
+	store, err := getArtifactStore()
+	if err != nil {
+		return err
+	}
+	job.Updated = time.Now()
+	data, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	return store.Put(getJobRecordName(job.ID), data, time.Minute*time.Duration(downloadTTLMins))
+}
+
+// take a job ID and return the job's saved record, or errArtifactNotFound when there is none
+func loadConversionJob(id string) (ConversionJob, error) {
+	store, err := getArtifactStore()
+	if err != nil {
+		return ConversionJob{}, err
+	}
+	data, err := store.Get(getJobRecordName(id))
+	if err == errInvalidArtifactName {
+		return ConversionJob{}, errArtifactNotFound
+	}
+	if err != nil {
+		return ConversionJob{}, err
+	}
+	var job ConversionJob
+	err = json.Unmarshal(data, &job)
+	return job, err
+}
+
+// take a slot for a new job and save it as running, refusing the job while every slot is taken
+func startConversionJob() (ConversionJob, *APIError) {
+	select {
+	case conversionJobSlots <- struct{}{}:
+	default:
+		return ConversionJob{}, newAPIError(http.StatusServiceUnavailable, errCodeTooManyJobs, "Too many conversion jobs, try again later")
+	}
+	job, err := newConversionJob()
+	if err == nil {
+		err = saveConversionJob(&job)
+	}
+	if err != nil {
+		<-conversionJobSlots
+		fmt.Println("ERROR: saving conversion job", err)
+		return ConversionJob{}, &APIError{Status: http.StatusInternalServerError, Code: errCodeStorageFailed, Message: "Saving the conversion job failed", err: err}
+	}
+	return job, nil
+}
+
+// return a job with an ID no saved job has
+func newConversionJob() (ConversionJob, error) {
+	store, err := getArtifactStore()
+	if err != nil {
+		return ConversionJob{}, err
+	}
+	for {
+		id := getRandomHex(conversionJobIDBytes)
+		if _, err := store.Get(getJobRecordName(id)); err != errArtifactNotFound {
+			if err != nil {
+				return ConversionJob{}, err
+			}
+			continue
+		}
+		return ConversionJob{ID: id, State: jobRunning, Created: time.Now()}, nil
+	}
+}
+
+// render, zip and store the job's files, then save and return the finished job and free its slot
+func finishConversionJob(job ConversionJob, cv conversion) (ConversionJob, *APIError) {
+	defer func() { <-conversionJobSlots }()
+	// jobs may outlive the request that submitted them, so only the render time limit applies
+	ctx, cancel := context.WithTimeout(context.Background(), getMaxRenderTime())
+	defer cancel()
+	err := cv.render(ctx)
+	var zipData []byte
+	if err == nil {
+		zipData, err = zipFiles(cv.Files)
+	}
+	var fileURL string
+	if err == nil {
+		fileURL, err = storeArtifact(getArtifactName(cv.Name), zipData)
+	}
+	if err != nil {
+		fmt.Println("ERROR: conversion job", job.ID, err)
+		job.State = jobFailed
+		job.Error = getAPIError(err)
 	} else {
-		errorResponse(w, http.StatusGatewayTimeout, "we hath failed thee")
+		job.State = jobSucceeded
+		job.Progress = 1
+		job.URL = fileURL
+	}
+	if err := saveConversionJob(&job); err != nil {
+		fmt.Println("ERROR: saving conversion job", job.ID, err)
+		return job, &APIError{Status: http.StatusInternalServerError, Code: errCodeStorageFailed, Message: "Saving the conversion job failed", err: err}
+	}
+	return job, nil
+}
+
+// accept a JSON payload or a file upload as a conversion job, render it and respond with the finished job
+func jobSubmissionHandler(w http.ResponseWriter, r *http.Request) {
+	var cv conversion
+	var ok bool
+	switch getRequestMediaType(r) {
+	case "application/json":
+		if isMixdownRequest(r) {
+			cv, ok = getMixdownConversion(w, r)
+		} else {
+			cv, ok = getJSONConversion(w, r)
+		}
+	case "multipart/form-data":
+		var u uploadRequest
+		if u, ok = parseUploadRequest(w, r); ok {
+			cv, ok = getUploadConversion(w, u)
+		}
+	default:
+		errorResponse(w, newAPIError(http.StatusUnsupportedMediaType, errCodeUnsupportedMediaType, "Content-Type must be application/json or multipart/form-data"))
+		return
+	}
+	if !ok {
+		return
 	}
+	job, apiErr := startConversionJob()
+	if apiErr != nil {
+		if apiErr.Code == errCodeTooManyJobs {
+			w.Header().Set("Retry-After", "10")
+		}
+		errorResponse(w, apiErr)
+		return
+	}
+	fmt.Println("Running conversion job", job.ID)
+	if job, apiErr = finishConversionJob(job, cv); apiErr != nil {
+		errorResponse(w, apiErr)
+		return
+	}
+	w.Header().Set("Location", "/api/convertor/jobs/"+job.ID)
+	jobResponse(w, http.StatusAccepted, job)
+}
+
+func jobStatusHandler(w http.ResponseWriter, r *http.Request, id string) {
+	job, err := loadConversionJob(id)
+	if err == errArtifactNotFound {
+		errorResponse(w, newAPIError(http.StatusNotFound, errCodeNotFound, fmt.Sprintf("no conversion job %v", id)))
+		return
+	}
+	if err != nil {
+		fmt.Println("ERROR: loading conversion job", id, err)
+		errorResponse(w, &APIError{Status: http.StatusBadGateway, Code: errCodeStorageFailed, Message: fmt.Sprintf("conversion job %v could not be fetched", id), err: err})
+		return
+	}
+	jobResponse(w, http.StatusOK, job)
+}
+
+func jobResponse(w http.ResponseWriter, statusCode int, job ConversionJob) {
+	data, _ := json.MarshalIndent(job, "", "    ")
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	w.Write(data)
 }
 
 // Handler ...
 // REST API to accept files for conversion
-// TODO: handle polyphonic MIDI - support or return helpful exception response
+//
+//	POST /api/convertor/json          Motivic JSON payload => zipped audio or MIDI file
+//	POST /api/convertor/mixdown       layered motifs with voices, levels, pans and offsets => zipped mix and stems
+//	POST /api/convertor/upload        MIDI or Motivic.json file => audio or JSON file download URL
+//	GET  /api/convertor/files/{name}  download a converted file
+//	POST /api/convertor/jobs          JSON payload or file upload => conversion job, kept for polling
+//	GET  /api/convertor/jobs/{id}     state, progress and download URL of a conversion job
+//	*    /api/convertor               legacy header-based routing of the three operations above
+//
 // TODO: increase conversion types:
 // 		Motivic.json file => MIDI
-// 		Motivic JSON payload => MIDI
 // 		Motivic JSON payload => WAV
-// 		MIDI files => Motivic JSON response
-// 		MIDI files => Motivic.json file
 func Handler(w http.ResponseWriter, r *http.Request) {
 	// set the music theory config
 	initMotivicConfig()
-	// NOTE: this is a hacky compromise to process distinct REST operations on the same endpoint
-	// I'm only doing this because the file conversion code currently writes a temp file to disk
-	// and since these are serverless functions, upload and download operations can't share a
-	// file system. To work around this, I'm parsing a request header to check whether or not this is
-	// an upload or download request.
-
 	// Let's check out those headers!
 	for k, v := range r.Header {
 		fmt.Printf("request header: [%s] [%s]\n", k, v)
 	}
-	// Check if the payload is JSON or a file
-	var isJSONOperation = false
-	if contentTypeHeader, ok := r.Header["Content-Type"]; ok {
-		//do something here
-		if contentTypeHeader[0] == "application/json" {
-			isJSONOperation = true
+	routePath := getRoutePath(r.URL.Path)
+	segments := strings.Split(routePath, "/")
+	switch {
+	case routePath == "json":
+		if allowMethods(w, r, http.MethodPost) && requireMediaType(w, r, "application/json") {
+			jsonDataConversionHandler(w, r)
+		}
+	case routePath == "mixdown":
+		if allowMethods(w, r, http.MethodPost) && requireMediaType(w, r, "application/json") {
+			mixdownHandler(w, r)
+		}
+	case routePath == "upload":
+		if allowMethods(w, r, http.MethodPost) && requireMediaType(w, r, "multipart/form-data") {
+			midiFileUploadHandler(w, r)
+		}
+	case routePath == "jobs":
+		if allowMethods(w, r, http.MethodPost) {
+			jobSubmissionHandler(w, r)
+		}
+	case len(segments) == 2 && segments[0] == "jobs":
+		if allowMethods(w, r, http.MethodGet, http.MethodHead) {
+			jobStatusHandler(w, r, segments[1])
+		}
+	case len(segments) == 2 && segments[0] == "files":
+		if allowMethods(w, r, http.MethodGet, http.MethodHead) {
+			fileDownloadHandler(w, r, segments[1])
+		}
+	case routePath == "":
+		legacyOperationHandler(w, r)
+	case len(segments) == 1:
+		// download URLs handed out before /files/ existed
+		if allowMethods(w, r, http.MethodGet, http.MethodHead) {
+			fileDownloadHandler(w, r, routePath)
 		}
+	default:
+		errorResponse(w, newAPIError(http.StatusNotFound, errCodeNotFound, fmt.Sprintf("no route for %v", r.URL.Path)))
+	}
+}
+
+// take the request path and return the part below the convertor endpoint,
+// which is mounted at /api/convertor but may be reached without the /api prefix
+func getRoutePath(urlPath string) string {
+	if i := strings.Index(urlPath, "/convertor"); i >= 0 {
+		urlPath = urlPath[i+len("/convertor"):]
+	}
+	return strings.Trim(urlPath, "/")
+}
+
+// respond 405 unless the request uses one of the route's methods
+func allowMethods(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	if Index(methods, r.Method) >= 0 {
+		return true
+	}
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	errorResponse(w, newAPIError(http.StatusMethodNotAllowed, errCodeMethodNotAllowed, fmt.Sprintf("%v is not allowed at %v", r.Method, r.URL.Path)))
+	return false
+}
+
+// respond 415 unless the request body has the route's media type, ignoring parameters like charset
+func requireMediaType(w http.ResponseWriter, r *http.Request, mediaType string) bool {
+	if getRequestMediaType(r) == mediaType {
+		return true
+	}
+	errorResponse(w, newAPIError(http.StatusUnsupportedMediaType, errCodeUnsupportedMediaType, fmt.Sprintf("Content-Type must be %v", mediaType)))
+	return false
+}
+
+func getRequestMediaType(r *http.Request) string {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return ""
 	}
-	if isJSONOperation {
+	return mediaType
+}
+
+// the original API served every operation from /api/convertor, telling JSON conversions,
+// uploads and downloads apart by the Content-Type and X-Motivic-Operation headers
+func legacyOperationHandler(w http.ResponseWriter, r *http.Request) {
+	mediaType := getRequestMediaType(r)
+	switch {
+	case r.Method == http.MethodPost && mediaType == "application/json":
 		fmt.Println("Handling as a JSON conversion...")
 		jsonDataConversionHandler(w, r)
-	} else {
+	case r.Method == http.MethodPost && (mediaType == "multipart/form-data" || r.Header.Get("X-Motivic-Operation") == "upload"):
 		fmt.Println("Handling as a File Upload operation...")
-
-		// Check the X-Motivic-Operation header to see if this is an upload or a download request and handle accordingly
-		var isFileUploadOperation bool = false
-
-		if operationHeader, ok := r.Header["X-Motivic-Operation"]; ok {
-			//do something here
-			if operationHeader[0] == "upload" {
-				isFileUploadOperation = true
-			}
-		}
-		if isFileUploadOperation {
+		if requireMediaType(w, r, "multipart/form-data") {
 			midiFileUploadHandler(w, r)
-		} else {
-			fileDownloadHandler(w, r)
 		}
+	case r.Method == http.MethodPost:
+		errorResponse(w, newAPIError(http.StatusUnsupportedMediaType, errCodeUnsupportedMediaType, "Content-Type must be application/json or multipart/form-data"))
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		fmt.Println("Bad request path")
+		errorResponse(w, newAPIError(http.StatusNotFound, errCodeNotFound, "Bad request path - no file name"))
+	default:
+		allowMethods(w, r, http.MethodPost)
 	}
 }
@@ -9,7 +9,6 @@ require (
 	github.com/go-audio/aiff v1.0.0
 	github.com/go-audio/audio v1.0.0
 	github.com/go-audio/generator v0.0.0-20190405005139-dbf5ce2499f1
-	github.com/go-audio/midi v1.0.0
 	github.com/go-audio/transforms v0.0.0-20180121090939-51830ccc35a5 // indirect
 	github.com/go-audio/wav v1.0.0
 	github.com/gordonklaus/portaudio v0.0.0-20180817120803-00e7307ccd93 // indirect
@@ -675,7 +675,7 @@ const MotivicUtils = {
             // OR IT WILL FAIL
             download: async function (motifs = [], voice = 'sine') {
                 const apiConfig = {
-                    url: '/api/convertor',
+                    url: '/api/convertor/json',
                     method: 'POST',
                     mode: 'cors',
                     headers: new Headers({